@@ -121,6 +121,7 @@ func loadModules(common, module Config) ([]Module, error) {
 					defer wait.Done()
 					err := module.Load(config)
 					if err != nil {
+						withdrawModule(module)
 						ch <- err
 					} else {
 						guard.Lock()
@@ -154,9 +155,10 @@ func unloadModules(modules []Module) error {
 	wait := sync.WaitGroup{}
 	for i := 0; i < len(modules); i++ {
 		module := modules[i]
-		wait.Add(i)
+		wait.Add(1)
 		go func() {
 			defer wait.Done()
+			defer withdrawModule(module)
 			err := module.Unload()
 			if err != nil {
 				ch <- err
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Backoff struct {
+	initial     time.Duration
+	max         time.Duration
+	factor      float64
+	attempts    int
+	decorrelate bool
+	attempt     int
+	last        time.Duration
+}
+
+type permanent struct {
+	error
+}
+
+func WithBackoff(initial time.Duration, max time.Duration, attempts int) *Backoff {
+	return &Backoff{initial: initial, max: max, factor: 2, attempts: attempts}
+}
+
+func WithDecorrelatedJitter(base time.Duration, max time.Duration, attempts int) *Backoff {
+	return &Backoff{initial: base, max: max, factor: 3, attempts: attempts, decorrelate: true}
+}
+
+func (this *Backoff) SetFactor(factor float64) *Backoff {
+	if factor >= 1 {
+		this.factor = factor
+	}
+	return this
+}
+
+func (this *Backoff) Attempt() int {
+	return this.attempt
+}
+
+func (this *Backoff) Reset() {
+	this.attempt = 0
+	this.last = 0
+}
+
+func (this *Backoff) Next(now time.Time) time.Time {
+	if this.attempts > 0 && this.attempt >= this.attempts {
+		return time.Time{}
+	}
+	this.attempt++
+	var delay time.Duration
+	if this.decorrelate {
+		upper := this.initial
+		if this.last > 0 {
+			upper = this.scale(this.last, this.factor)
+		}
+		delay = this.initial
+		if upper > this.initial {
+			delay += time.Duration(rand.Int63n(int64(upper - this.initial)))
+		}
+	} else {
+		delay = this.scale(this.initial, math.Pow(this.factor, float64(this.attempt-1)))
+	}
+	if this.max > 0 && delay > this.max {
+		delay = this.max
+	}
+	this.last = delay
+	return now.Add(delay)
+}
+
+func (this *Backoff) scale(delay time.Duration, factor float64) time.Duration {
+	result := float64(delay) * factor
+	if result >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(result)
+}
+
+func (this permanent) Unwrap() error {
+	return this.error
+}
+
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanent{err}
+}
+
+func Sleep(d time.Duration) error {
+	this := InLoop().(*loop)
+	if err := this.Err(); err != nil {
+		return err
+	}
+	this.pause(func(wake func()) {
+		timer := NewTimer(TimeoutFunc(func(timer Timer) error {
+			wake()
+			return nil
+		}))
+		timer.StartNow(WithDelay(d))
+	})
+	return this.Err()
+}
+
+func Retry(action func() error, schedule TimerSchedule) error {
+	this := InLoop().(*loop)
+	if reset, ok := schedule.(interface{ Reset() }); ok {
+		reset.Reset()
+	}
+	for {
+		err := action()
+		if err == nil {
+			return nil
+		}
+		var stop permanent
+		if errors.As(err, &stop) {
+			return stop.error
+		}
+		now := this.timers.now()
+		next := schedule.Next(now)
+		if next.IsZero() {
+			return err
+		}
+		if err := Sleep(next.Sub(now)); err != nil {
+			return err
+		}
+	}
+}
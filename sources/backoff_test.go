@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestBackoff(t *testing.T) {
+	start := time.Unix(0, 0)
+	backoff := WithBackoff(time.Second, time.Second*5, 5)
+	var delays []time.Duration
+	for next := backoff.Next(start); !next.IsZero(); next = backoff.Next(start) {
+		delays = append(delays, next.Sub(start))
+	}
+	expect := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5}
+	if !reflect.DeepEqual(delays, expect) {
+		t.Fatalf("expect %v, got %v", expect, delays)
+	}
+	jitter := WithDecorrelatedJitter(time.Second, time.Second*10, 0)
+	for i := 0; i < 100; i++ {
+		delay := jitter.Next(start).Sub(start)
+		if delay < time.Second || delay > time.Second*10 {
+			t.Fatalf("delay %v out of range", delay)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var attempts []time.Duration
+	result := make(chan error, 2)
+	loop.Execute(ExecFunc(func() error {
+		result <- Retry(func() error {
+			attempts = append(attempts, Now().Sub(start))
+			if len(attempts) < 4 {
+				return errors.New("unavailable")
+			}
+			return nil
+		}, WithBackoff(time.Second, time.Minute, 0))
+		result <- Retry(func() error {
+			return Permanent(errors.New("denied"))
+		}, WithBackoff(time.Second, time.Minute, 0))
+		return nil
+	}))
+	loop.Advance(time.Minute)
+	expect := []time.Duration{0, time.Second, time.Second * 3, time.Second * 7}
+	if !reflect.DeepEqual(attempts, expect) {
+		t.Fatalf("expect %v, got %v", expect, attempts)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err == nil || err.Error() != "denied" {
+		t.Fatalf("expect permanent error, got %v", err)
+	}
+}
+
+func TestSleepCancel(t *testing.T) {
+	loop := StartLoop()
+	result := make(chan error, 2)
+	loop.Execute(ExecFunc(func() error {
+		result <- Sleep(time.Hour)
+		result <- Sleep(time.Hour)
+		return nil
+	}))
+	time.Sleep(time.Millisecond * 10)
+	loop.Cancel()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-result:
+			if err != context.Canceled {
+				t.Fatalf("expect cancelled, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Sleep not woken by cancellation")
+		}
+	}
+}
+
+func TestRetryReset(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	backoff := WithBackoff(time.Second, time.Minute, 2)
+	result := make(chan error, 2)
+	loop.Execute(ExecFunc(func() error {
+		for i := 0; i < 2; i++ {
+			result <- Retry(func() error {
+				return errors.New("unavailable")
+			}, backoff)
+		}
+		return nil
+	}))
+	loop.Advance(time.Second * 3)
+	if len(result) != 1 {
+		t.Fatal("expect reused backoff to start over")
+	}
+	if err := <-result; err == nil {
+		t.Fatal("expect error")
+	}
+	loop.Advance(time.Second * 3)
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("expect error")
+		}
+	default:
+		t.Fatal("expect reused backoff to start over")
+	}
+	if backoff.Attempt() != 2 {
+		t.Fatalf("expect 2 attempts, got %d", backoff.Attempt())
+	}
+}
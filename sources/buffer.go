@@ -3,13 +3,21 @@ package relay
 import (
 	gerrors "errors"
 	"io"
+	"net"
+	"relay/log"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 var ErrReading = gerrors.New("reading")
 var ErrWriting = gerrors.New("writing")
+var ErrBufferBudget = gerrors.New("buffer budget exceeded")
 
 type Buffer interface {
 	Empty() bool
@@ -19,33 +27,265 @@ type Buffer interface {
 	io.Writer
 	io.ByteReader
 	io.ByteWriter
+	io.WriterTo
+	io.ReaderFrom
 	BeginRead() ([]byte, error)
 	EndRead(read int) bool
 	BeginWrite() ([]byte, error)
 	EndWrite(wrote int) bool
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	Slice(offset int, length int) (Buffer, error)
+	Split(n int) (Buffer, error)
+	Clone() Buffer
+	Append(other Buffer) error
 }
 
 type BufferPool interface {
 	New() Buffer
+	Stats() BufferPoolStats
+}
+
+type BufferPoolOptions struct {
+	classes []int
+	size    int
+}
+
+type BufferPoolStats struct {
+	InUse   int64
+	Failed  uint64
+	Classes []BufferClassStats
+}
+
+type BufferClassStats struct {
+	Size     int
+	InUse    int64
+	Allocs   uint64
+	Releases uint64
+}
+
+type BufferLeak struct {
+	Stack string
+	Since time.Time
+}
+
+func DefaultBufferPoolOptions() BufferPoolOptions {
+	return BufferPoolOptions{classes: []int{512, 4096, 32768}, size: 4096}
+}
+
+func (this BufferPoolOptions) SetClasses(sizes ...int) BufferPoolOptions {
+	classes := make([]int, 0, len(sizes))
+	for _, size := range sizes {
+		if size > 0 {
+			classes = append(classes, size)
+		}
+	}
+	sort.Ints(classes)
+	this.classes = classes
+	return this
+}
+
+func (this BufferPoolOptions) SetDefaultSize(size int) BufferPoolOptions {
+	this.size = size
+	return this
 }
 
 func NewBufferPool(size int) BufferPool {
 	if size <= 0 {
 		panic(errors.New("pool size incorrect"))
 	}
+	return NewBufferPoolWith(DefaultBufferPoolOptions().SetClasses(size).SetDefaultSize(size))
+}
+
+func NewBufferPoolWith(options BufferPoolOptions) BufferPool {
+	if len(options.classes) == 0 {
+		panic(errors.New("pool size incorrect"))
+	}
 	pool := &bufferpool{}
-	pool.pool.New = func() any {
-		return &buffernode{bytes: make([]byte, size)}
+	for _, size := range options.classes {
+		class := &bufferclass{size: size}
+		class.pool.New = func() any {
+			return &bufferblock{bytes: make([]byte, class.size), class: class}
+		}
+		pool.classes = append(pool.classes, class)
 	}
+	pool.base = pool.class(options.size)
 	return pool
 }
 
+func SetBufferBudget(limit int64) {
+	atomic.StoreInt64(&bufferbudget.limit, limit)
+	bufferbudgetrelease()
+}
+
+func BufferBudget() (used int64, limit int64) {
+	return atomic.LoadInt64(&bufferbudget.used), atomic.LoadInt64(&bufferbudget.limit)
+}
+
+func BufferBudgetReleased() <-chan struct{} {
+	bufferbudget.guard.Lock()
+	defer bufferbudget.guard.Unlock()
+	if bufferbudget.released == nil {
+		bufferbudget.released = make(chan struct{})
+	}
+	return bufferbudget.released
+}
+
+func WaitBufferBudget(size int64, done <-chan struct{}) bool {
+	for {
+		released := BufferBudgetReleased()
+		used, limit := BufferBudget()
+		if limit <= 0 || used+size <= limit {
+			return true
+		}
+		select {
+		case <-released:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func SetBufferDebug(enable bool) {
+	if enable {
+		atomic.StoreInt32(&bufferdebug, 1)
+	} else {
+		atomic.StoreInt32(&bufferdebug, 0)
+	}
+}
+
+func BufferOutstanding() []BufferLeak {
+	buffertracks.guard.Lock()
+	defer buffertracks.guard.Unlock()
+	result := make([]BufferLeak, 0, len(buffertracks.live))
+	for track := range buffertracks.live {
+		if track.held {
+			result = append(result, BufferLeak{Stack: track.stack, Since: track.since})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Since.Before(result[j].Since)
+	})
+	return result
+}
+
+func BufferLeaks() []BufferLeak {
+	buffertracks.guard.Lock()
+	defer buffertracks.guard.Unlock()
+	return append([]BufferLeak(nil), buffertracks.leaks...)
+}
+
+const maxbufferleaks = 64
+
+var bufferbudget struct {
+	limit    int64
+	used     int64
+	guard    sync.Mutex
+	released chan struct{}
+}
+
+var bufferdebug int32
+
+func bufferbudgetrelease() {
+	bufferbudget.guard.Lock()
+	defer bufferbudget.guard.Unlock()
+	if bufferbudget.released != nil {
+		close(bufferbudget.released)
+		bufferbudget.released = nil
+	}
+}
+
+var buffertracks = struct {
+	guard sync.Mutex
+	live  map[*buffertrack]struct{}
+	leaks []BufferLeak
+}{live: make(map[*buffertrack]struct{})}
+
 type bufferpool struct {
-	pool sync.Pool
+	classes []*bufferclass
+	base    *bufferclass
+	failed  uint64
+}
+
+type bufferclass struct {
+	size     int
+	pool     sync.Pool
+	inuse    int64
+	allocs   uint64
+	releases uint64
+}
+
+type buffertrack struct {
+	stack string
+	since time.Time
+	held  bool
 }
 
 func (this *bufferpool) New() Buffer {
-	return &buffer{pool: this}
+	result := &buffer{pool: this}
+	if atomic.LoadInt32(&bufferdebug) != 0 {
+		result.track = &buffertrack{stack: string(debug.Stack()), since: time.Now()}
+		buffertracks.guard.Lock()
+		buffertracks.live[result.track] = Void
+		buffertracks.guard.Unlock()
+		runtime.SetFinalizer(result, (*buffer).finalize)
+	}
+	return result
+}
+
+func (this *bufferpool) Stats() BufferPoolStats {
+	result := BufferPoolStats{Failed: atomic.LoadUint64(&this.failed)}
+	for _, class := range this.classes {
+		stats := BufferClassStats{
+			Size:     class.size,
+			InUse:    atomic.LoadInt64(&class.inuse),
+			Allocs:   atomic.LoadUint64(&class.allocs),
+			Releases: atomic.LoadUint64(&class.releases),
+		}
+		result.InUse += stats.InUse * int64(class.size)
+		result.Classes = append(result.Classes, stats)
+	}
+	return result
+}
+
+func (this *bufferpool) class(size int) *bufferclass {
+	for _, class := range this.classes {
+		if class.size >= size {
+			return class
+		}
+	}
+	return this.classes[len(this.classes)-1]
+}
+
+func (this *bufferpool) alloc(hint int) (*buffernode, error) {
+	class := this.base
+	if hint > 0 {
+		class = this.class(hint)
+	}
+	size := int64(class.size)
+	used := atomic.AddInt64(&bufferbudget.used, size)
+	if limit := atomic.LoadInt64(&bufferbudget.limit); limit > 0 && used > limit {
+		atomic.AddInt64(&bufferbudget.used, -size)
+		atomic.AddUint64(&this.failed, 1)
+		return nil, ErrBufferBudget
+	}
+	atomic.AddInt64(&class.inuse, 1)
+	atomic.AddUint64(&class.allocs, 1)
+	block := class.pool.Get().(*bufferblock)
+	block.refs = 1
+	node := nodepool.Get().(*buffernode)
+	node.block = block
+	return node, nil
+}
+
+func (this *bufferclass) release(block *bufferblock) {
+	atomic.AddInt64(&bufferbudget.used, -int64(this.size))
+	atomic.AddInt64(&this.inuse, -1)
+	atomic.AddUint64(&this.releases, 1)
+	this.pool.Put(block)
+	if atomic.LoadInt64(&bufferbudget.limit) > 0 {
+		bufferbudgetrelease()
+	}
 }
 
 type buffer struct {
@@ -54,35 +294,68 @@ type buffer struct {
 	write   *buffernode
 	reading bool
 	writing bool
+	track   *buffertrack
 }
 
-type buffernode struct {
+type bufferblock struct {
 	bytes []byte
+	refs  int32
+	class *bufferclass
+}
+
+type buffernode struct {
+	block *bufferblock
 	read  int
 	write int
 	next  *buffernode
 }
 
-func (this *buffer) Empty() bool {
-	if this.read == nil {
-		return true
+var nodepool = sync.Pool{New: func() any {
+	return &buffernode{}
+}}
+
+func (this *buffernode) bytes() []byte {
+	return this.block.bytes[this.read:this.write]
+}
+
+func (this *buffernode) writable() bool {
+	return this.write < len(this.block.bytes) && atomic.LoadInt32(&this.block.refs) == 1
+}
+
+func (this *buffernode) share(read int, write int) *buffernode {
+	atomic.AddInt32(&this.block.refs, 1)
+	node := nodepool.Get().(*buffernode)
+	node.block = this.block
+	node.read = read
+	node.write = write
+	return node
+}
+
+func (this *buffernode) release() {
+	block := this.block
+	if atomic.AddInt32(&block.refs, -1) == 0 {
+		block.class.release(block)
 	}
-	if this.read != this.write {
-		return false
+	this.block = nil
+	this.read = 0
+	this.write = 0
+	this.next = nil
+	nodepool.Put(this)
+}
+
+func (this *buffer) Empty() bool {
+	for cursor := this.read; cursor != nil; cursor = cursor.next {
+		if cursor.read != cursor.write {
+			return false
+		}
 	}
-	return this.read.read == this.read.write
+	return true
 }
 
 func (this *buffer) Len() int {
 	sum := 0
-	cursor := this.read
-	for cursor != nil {
-		if cursor == this.write {
-			sum += this.write.write - cursor.read
-			break
-		}
+	for cursor := this.read; cursor != nil; cursor = cursor.next {
 		sum += cursor.write - cursor.read
-		cursor = cursor.next
 	}
 	return sum
 }
@@ -91,16 +364,78 @@ func (this *buffer) Reset() {
 	cursor := this.read
 	for cursor != nil {
 		next := cursor.next
-		cursor.next = nil
-		cursor.read = 0
-		cursor.write = 0
-		this.pool.pool.Put(cursor)
+		cursor.release()
 		cursor = next
 	}
 	this.read = nil
 	this.write = nil
 	this.reading = false
 	this.writing = false
+	this.hold(false)
+}
+
+func (this *buffer) hold(held bool) {
+	if this.track == nil || this.track.held == held {
+		return
+	}
+	buffertracks.guard.Lock()
+	this.track.held = held
+	buffertracks.guard.Unlock()
+}
+
+func (this *buffer) finalize() {
+	buffertracks.guard.Lock()
+	delete(buffertracks.live, this.track)
+	leaked := this.track.held
+	if leaked {
+		if len(buffertracks.leaks) == maxbufferleaks {
+			buffertracks.leaks = buffertracks.leaks[1:]
+		}
+		buffertracks.leaks = append(buffertracks.leaks, BufferLeak{Stack: this.track.stack, Since: this.track.since})
+	}
+	buffertracks.guard.Unlock()
+	if leaked {
+		log.Ctx(Application).Error().Str("stack", this.track.stack).Time("since", this.track.since).Msg("buffer leaked without Reset")
+		this.Reset()
+	}
+}
+
+func (this *buffer) consume() bool {
+	cursor := this.read
+	if cursor.read != cursor.write {
+		return true
+	}
+	next := cursor.next
+	if this.writing && next == nil {
+		return false
+	}
+	this.read = next
+	cursor.release()
+	if this.read == nil {
+		this.write = nil
+		this.hold(false)
+		return false
+	}
+	return true
+}
+
+func (this *buffer) tail(hint int) (*buffernode, error) {
+	cursor := this.write
+	if cursor != nil && cursor.writable() {
+		return cursor, nil
+	}
+	node, err := this.pool.alloc(hint)
+	if err != nil {
+		return nil, err
+	}
+	if cursor == nil {
+		this.read = node
+		this.hold(true)
+	} else {
+		cursor.next = node
+	}
+	this.write = node
+	return node, nil
 }
 
 func (this *buffer) Read(bytes []byte) (int, error) {
@@ -112,28 +447,13 @@ func (this *buffer) Read(bytes []byte) (int, error) {
 		return 0, nil
 	}
 	sum := 0
-	if this.read != nil {
-		for sum < max {
-			cursor := this.read
-			result := copy(bytes[sum:], cursor.bytes[cursor.read:cursor.write])
-			cursor.read += result
-			sum += result
-			if cursor.read != cursor.write {
-				continue
-			}
-			next := cursor.next
-			if this.writing && next == nil {
-				break
-			}
-			this.read = next
-			cursor.next = nil
-			cursor.read = 0
-			cursor.write = 0
-			this.pool.pool.Put(cursor)
-			if this.read == nil {
-				this.Reset()
-				break
-			}
+	for sum < max && this.read != nil {
+		cursor := this.read
+		result := copy(bytes[sum:], cursor.bytes())
+		cursor.read += result
+		sum += result
+		if !this.consume() {
+			break
 		}
 	}
 	if sum == 0 {
@@ -146,29 +466,19 @@ func (this *buffer) ReadByte() (byte, error) {
 	if this.reading {
 		return 0, ErrReading
 	}
-	cursor := this.read
-	if cursor == nil {
-		return 0, io.EOF
-	}
-	if cursor.read == cursor.write {
-		return 0, io.EOF
-	}
-	result := cursor.bytes[cursor.read]
-	cursor.read++
-	if cursor.read == cursor.write {
-		next := cursor.next
-		if !this.writing || next != nil {
-			this.read = next
-			cursor.next = nil
-			cursor.read = 0
-			cursor.write = 0
-			this.pool.pool.Put(cursor)
-			if this.read == nil {
-				this.Reset()
-			}
+	for this.read != nil {
+		cursor := this.read
+		if cursor.read != cursor.write {
+			result := cursor.block.bytes[cursor.read]
+			cursor.read++
+			this.consume()
+			return result, nil
+		}
+		if !this.consume() {
+			break
 		}
 	}
-	return result, nil
+	return 0, io.EOF
 }
 
 func (this *buffer) Write(bytes []byte) (int, error) {
@@ -178,18 +488,11 @@ func (this *buffer) Write(bytes []byte) (int, error) {
 	max := len(bytes)
 	sum := 0
 	for sum < max {
-		cursor := this.write
-		if cursor == nil {
-			cursor = this.pool.pool.Get().(*buffernode)
-			this.write = cursor
-			this.read = cursor
+		cursor, err := this.tail(max - sum)
+		if err != nil {
+			return sum, err
 		}
-		if cursor.write == len(cursor.bytes) {
-			cursor = this.pool.pool.Get().(*buffernode)
-			this.write.next = cursor
-			this.write = cursor
-		}
-		result := copy(cursor.bytes[cursor.write:], bytes[sum:])
+		result := copy(cursor.block.bytes[cursor.write:], bytes[sum:])
 		cursor.write += result
 		sum += result
 	}
@@ -200,18 +503,11 @@ func (this *buffer) WriteByte(c byte) error {
 	if this.writing {
 		return ErrWriting
 	}
-	cursor := this.write
-	if cursor == nil {
-		cursor = this.pool.pool.Get().(*buffernode)
-		this.write = cursor
-		this.read = cursor
-	}
-	if cursor.write == len(cursor.bytes) {
-		cursor = this.pool.pool.Get().(*buffernode)
-		this.write.next = cursor
-		this.write = cursor
+	cursor, err := this.tail(0)
+	if err != nil {
+		return err
 	}
-	cursor.bytes[cursor.write] = c
+	cursor.block.bytes[cursor.write] = c
 	cursor.write++
 	return nil
 }
@@ -221,10 +517,15 @@ func (this *buffer) BeginRead() ([]byte, error) {
 		return nil, ErrReading
 	}
 	this.reading = true
+	for this.read != nil && this.read.read == this.read.write {
+		if !this.consume() {
+			break
+		}
+	}
 	if this.read == nil {
 		return nil, nil
 	}
-	return this.read.bytes[this.read.read:this.read.write], nil
+	return this.read.bytes(), nil
 }
 
 func (this *buffer) EndRead(read int) bool {
@@ -243,19 +544,7 @@ func (this *buffer) EndRead(read int) bool {
 		return false
 	}
 	cursor.read += read
-	if cursor.read == cursor.write {
-		next := cursor.next
-		if !this.writing || next != nil {
-			this.read = next
-			cursor.next = nil
-			cursor.read = 0
-			cursor.write = 0
-			this.pool.pool.Put(cursor)
-			if this.read == nil {
-				this.Reset()
-			}
-		}
-	}
+	this.consume()
 	return true
 }
 
@@ -263,19 +552,12 @@ func (this *buffer) BeginWrite() ([]byte, error) {
 	if this.writing {
 		return nil, ErrWriting
 	}
-	this.writing = true
-	cursor := this.write
-	if cursor == nil {
-		cursor = this.pool.pool.Get().(*buffernode)
-		this.write = cursor
-		this.read = cursor
-	}
-	if cursor.write == len(cursor.bytes) {
-		cursor = this.pool.pool.Get().(*buffernode)
-		this.write.next = cursor
-		this.write = cursor
+	cursor, err := this.tail(0)
+	if err != nil {
+		return nil, err
 	}
-	return cursor.bytes[cursor.write:], nil
+	this.writing = true
+	return cursor.block.bytes[cursor.write:], nil
 }
 
 func (this *buffer) EndWrite(wrote int) bool {
@@ -283,9 +565,181 @@ func (this *buffer) EndWrite(wrote int) bool {
 		return false
 	}
 	this.writing = false
-	if this.write.write+wrote > len(this.write.bytes) {
+	if this.write.write+wrote > len(this.write.block.bytes) {
 		return false
 	}
 	this.write.write += wrote
 	return true
 }
+
+func (this *buffer) Peek(n int) ([]byte, error) {
+	if this.reading {
+		return nil, ErrReading
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	cursor := this.read
+	for cursor != nil && cursor.read == cursor.write {
+		cursor = cursor.next
+	}
+	if cursor != nil && cursor.write-cursor.read >= n {
+		return cursor.block.bytes[cursor.read : cursor.read+n], nil
+	}
+	if this.Len() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	result := make([]byte, 0, n)
+	for ; len(result) < n; cursor = cursor.next {
+		bytes := cursor.bytes()
+		if len(bytes) > n-len(result) {
+			bytes = bytes[:n-len(result)]
+		}
+		result = append(result, bytes...)
+	}
+	return result, nil
+}
+
+func (this *buffer) Discard(n int) (int, error) {
+	if this.reading {
+		return 0, ErrReading
+	}
+	sum := 0
+	for sum < n && this.read != nil {
+		cursor := this.read
+		result := cursor.write - cursor.read
+		if result > n-sum {
+			result = n - sum
+		}
+		cursor.read += result
+		sum += result
+		if !this.consume() {
+			break
+		}
+	}
+	if sum < n {
+		return sum, io.EOF
+	}
+	return sum, nil
+}
+
+func (this *buffer) Slice(offset int, length int) (Buffer, error) {
+	if offset < 0 || length < 0 || offset+length > this.Len() {
+		return nil, errors.Errorf("slice [%d:%d] out of range %d", offset, offset+length, this.Len())
+	}
+	result := this.pool.New().(*buffer)
+	for cursor := this.read; cursor != nil && length > 0; cursor = cursor.next {
+		size := cursor.write - cursor.read
+		if offset >= size {
+			offset -= size
+			continue
+		}
+		read := cursor.read + offset
+		write := cursor.write
+		if write-read > length {
+			write = read + length
+		}
+		offset = 0
+		length -= write - read
+		node := cursor.share(read, write)
+		if result.write == nil {
+			result.read = node
+			result.hold(true)
+		} else {
+			result.write.next = node
+		}
+		result.write = node
+	}
+	return result, nil
+}
+
+func (this *buffer) Split(n int) (Buffer, error) {
+	if this.reading {
+		return nil, ErrReading
+	}
+	result, err := this.Slice(0, n)
+	if err != nil {
+		return nil, err
+	}
+	this.Discard(n)
+	return result, nil
+}
+
+func (this *buffer) Clone() Buffer {
+	result, _ := this.Slice(0, this.Len())
+	return result
+}
+
+func (this *buffer) Append(other Buffer) error {
+	if this.writing {
+		return ErrWriting
+	}
+	source, ok := other.(*buffer)
+	if !ok {
+		_, err := other.WriteTo(this)
+		return err
+	}
+	if source == this {
+		return errors.New("can not append a buffer to itself")
+	}
+	if source.reading {
+		return ErrReading
+	}
+	if source.writing {
+		return ErrWriting
+	}
+	if source.read == nil {
+		return nil
+	}
+	if this.write == nil {
+		this.read = source.read
+		this.hold(true)
+	} else {
+		this.write.next = source.read
+	}
+	this.write = source.write
+	source.read = nil
+	source.write = nil
+	source.hold(false)
+	return nil
+}
+
+func (this *buffer) WriteTo(w io.Writer) (int64, error) {
+	if this.reading {
+		return 0, ErrReading
+	}
+	var buffers net.Buffers
+	for cursor := this.read; cursor != nil; cursor = cursor.next {
+		if cursor.read != cursor.write {
+			buffers = append(buffers, cursor.bytes())
+		}
+	}
+	if len(buffers) == 0 {
+		return 0, nil
+	}
+	n, err := buffers.WriteTo(w)
+	this.Discard(int(n))
+	return n, err
+}
+
+func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
+	if this.writing {
+		return 0, ErrWriting
+	}
+	var sum int64
+	for {
+		cursor, err := this.tail(0)
+		if err != nil {
+			return sum, err
+		}
+		n, err := r.Read(cursor.block.bytes[cursor.write:])
+		cursor.write += n
+		sum += int64(n)
+		if err == io.EOF {
+			return sum, nil
+		}
+		if err != nil {
+			return sum, err
+		}
+	}
+}
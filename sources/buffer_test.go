@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferShare(t *testing.T) {
+	pool := NewBufferPool(4)
+	buffer := pool.New()
+	buffer.Write([]byte("hello world"))
+	peek, err := buffer.Peek(3)
+	if err != nil || string(peek) != "hel" {
+		t.Fatalf("unexpected peek %q %v", peek, err)
+	}
+	peek, err = buffer.Peek(6)
+	if err != nil || string(peek) != "hello " {
+		t.Fatalf("unexpected peek %q %v", peek, err)
+	}
+	if _, err := buffer.Peek(12); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect unexpected eof, got %v", err)
+	}
+	slice, err := buffer.Slice(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := buffer.Clone()
+	head, err := buffer.Split(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Write([]byte("!!"))
+	clone.Write([]byte("??"))
+	expects := map[string]Buffer{"lo wo": slice, "hello ": head, "world!!": buffer, "hello world??": clone}
+	for expect, value := range expects {
+		result, _ := io.ReadAll(value)
+		if string(result) != expect {
+			t.Fatalf("expect %q, got %q", expect, result)
+		}
+		value.Reset()
+	}
+}
+
+func TestBufferWriteTo(t *testing.T) {
+	pool := NewBufferPool(3)
+	frame := pool.New()
+	frame.Write([]byte("broadcast frame"))
+	var outputs [3]bytes.Buffer
+	for i := range outputs {
+		n, err := frame.Clone().WriteTo(&outputs[i])
+		if err != nil || n != 15 {
+			t.Fatalf("unexpected write %d %v", n, err)
+		}
+	}
+	for _, output := range outputs {
+		if output.String() != "broadcast frame" {
+			t.Fatalf("unexpected output %q", output.String())
+		}
+	}
+	other := pool.New()
+	other.ReadFrom(bytes.NewReader([]byte("head:")))
+	if err := other.Append(frame); err != nil {
+		t.Fatal(err)
+	}
+	if !frame.Empty() {
+		t.Fatal("expect appended buffer to be empty")
+	}
+	result, _ := io.ReadAll(other)
+	if string(result) != "head:broadcast frame" {
+		t.Fatalf("unexpected result %q", result)
+	}
+}
+
+func TestBufferPoolClasses(t *testing.T) {
+	pool := NewBufferPoolWith(DefaultBufferPoolOptions().SetClasses(16, 64, 256).SetDefaultSize(64))
+	buffer := pool.New()
+	buffer.Write(make([]byte, 10))
+	buffer.Write(make([]byte, 100))
+	stats := pool.Stats()
+	if stats.Classes[0].InUse != 1 || stats.Classes[1].InUse != 0 || stats.Classes[2].InUse != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	buffer.Reset()
+	if stats := pool.Stats(); stats.InUse != 0 || stats.Classes[2].Releases != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBufferBudget(t *testing.T) {
+	used, _ := BufferBudget()
+	SetBufferBudget(used + 64)
+	defer SetBufferBudget(0)
+	pool := NewBufferPool(32)
+	buffer := pool.New()
+	if _, err := buffer.Write(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.WriteByte(1); err != ErrBufferBudget {
+		t.Fatalf("expect budget error, got %v", err)
+	}
+	if pool.Stats().Failed != 1 {
+		t.Fatal("expect a failed allocation")
+	}
+	buffer.Reset()
+	if err := buffer.WriteByte(1); err != nil {
+		t.Fatal(err)
+	}
+	buffer.Reset()
+}
+
+func TestBufferBudgetWait(t *testing.T) {
+	used, _ := BufferBudget()
+	SetBufferBudget(used + 64)
+	defer SetBufferBudget(0)
+	pool := NewBufferPool(32)
+	buffer := pool.New()
+	if _, err := buffer.Write(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	if WaitBufferBudget(32, closedchan()) {
+		t.Fatal("expect wait to stop when done is closed")
+	}
+	waited := make(chan bool, 1)
+	go func() {
+		waited <- WaitBufferBudget(32, done)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("expect wait to block while the budget is exhausted")
+	case <-time.After(time.Millisecond * 20):
+	}
+	buffer.Reset()
+	select {
+	case ok := <-waited:
+		if !ok {
+			t.Fatal("expect budget to be available")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect release to wake the waiter")
+	}
+	close(done)
+}
+
+func TestBufferBudgetWaitNearLimit(t *testing.T) {
+	used, _ := BufferBudget()
+	SetBufferBudget(used + 48)
+	defer SetBufferBudget(0)
+	pool := NewBufferPool(32)
+	buffer := pool.New()
+	if err := buffer.WriteByte(1); err != nil {
+		t.Fatal(err)
+	}
+	other := pool.New()
+	if err := other.WriteByte(1); err != ErrBufferBudget {
+		t.Fatalf("expect budget error, got %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	waited := make(chan bool, 1)
+	go func() {
+		waited <- WaitBufferBudget(32, done)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("expect wait to block while less than one block is left")
+	case <-time.After(time.Millisecond * 20):
+	}
+	buffer.Reset()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("expect release to wake the waiter")
+	}
+	if err := other.WriteByte(1); err != nil {
+		t.Fatal(err)
+	}
+	other.Reset()
+}
+
+func closedchan() <-chan struct{} {
+	result := make(chan struct{})
+	close(result)
+	return result
+}
+
+func TestBufferLeak(t *testing.T) {
+	SetBufferDebug(true)
+	defer SetBufferDebug(false)
+	pool := NewBufferPool(32)
+	before := len(BufferLeaks())
+	func() {
+		pool.New().Write([]byte("leak"))
+		kept := pool.New()
+		kept.Write([]byte("kept"))
+		if len(BufferOutstanding()) == 0 {
+			t.Fatal("expect outstanding buffers")
+		}
+		kept.Reset()
+	}()
+	for i := 0; i < 10 && len(BufferLeaks()) == before; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond * 10)
+	}
+	leaks := BufferLeaks()
+	if len(leaks) != before+1 || !strings.Contains(leaks[len(leaks)-1].Stack, "TestBufferLeak") {
+		t.Fatalf("expect a leak reported from the test, got %d", len(leaks)-before)
+	}
+}
@@ -0,0 +1,330 @@
+package relay
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const maxbufferlength = 16 << 20
+
+type BufferReader struct {
+	buffer   Buffer
+	order    binary.ByteOrder
+	position int
+	mark     int
+	max      int
+}
+
+type BufferWriter struct {
+	buffer  Buffer
+	order   binary.ByteOrder
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func NewBufferReader(buffer Buffer) *BufferReader {
+	return &BufferReader{buffer: buffer, order: binary.BigEndian, max: maxbufferlength}
+}
+
+func (this *BufferReader) SetOrder(order binary.ByteOrder) *BufferReader {
+	this.order = order
+	return this
+}
+
+func (this *BufferReader) SetMaxLength(max int) *BufferReader {
+	if max > 0 {
+		this.max = max
+	}
+	return this
+}
+
+func (this *BufferReader) Position() int {
+	return this.position
+}
+
+func (this *BufferReader) Remaining() int {
+	return this.buffer.Len() - this.position
+}
+
+func (this *BufferReader) Mark() {
+	this.mark = this.position
+}
+
+func (this *BufferReader) Rewind() {
+	this.position = this.mark
+}
+
+func (this *BufferReader) Commit() error {
+	_, err := this.buffer.Discard(this.position)
+	this.position = 0
+	this.mark = 0
+	return err
+}
+
+func (this *BufferReader) Skip(n int) error {
+	if n < 0 || this.Remaining() < n {
+		return io.ErrUnexpectedEOF
+	}
+	this.position += n
+	return nil
+}
+
+func (this *BufferReader) Uint8() (uint8, error) {
+	var bytes [1]byte
+	if !this.take(bytes[:]) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return bytes[0], nil
+}
+
+func (this *BufferReader) Uint16() (uint16, error) {
+	var bytes [2]byte
+	if !this.take(bytes[:]) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return this.order.Uint16(bytes[:]), nil
+}
+
+func (this *BufferReader) Uint32() (uint32, error) {
+	var bytes [4]byte
+	if !this.take(bytes[:]) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return this.order.Uint32(bytes[:]), nil
+}
+
+func (this *BufferReader) Uint64() (uint64, error) {
+	var bytes [8]byte
+	if !this.take(bytes[:]) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return this.order.Uint64(bytes[:]), nil
+}
+
+func (this *BufferReader) Int8() (int8, error) {
+	value, err := this.Uint8()
+	return int8(value), err
+}
+
+func (this *BufferReader) Int16() (int16, error) {
+	value, err := this.Uint16()
+	return int16(value), err
+}
+
+func (this *BufferReader) Int32() (int32, error) {
+	value, err := this.Uint32()
+	return int32(value), err
+}
+
+func (this *BufferReader) Int64() (int64, error) {
+	value, err := this.Uint64()
+	return int64(value), err
+}
+
+func (this *BufferReader) Float32() (float32, error) {
+	value, err := this.Uint32()
+	return math.Float32frombits(value), err
+}
+
+func (this *BufferReader) Float64() (float64, error) {
+	value, err := this.Uint64()
+	return math.Float64frombits(value), err
+}
+
+func (this *BufferReader) Uvarint() (uint64, error) {
+	var value uint64
+	var shift uint
+	var bytes [1]byte
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		if !this.copyat(this.position+i, bytes[:]) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		c := bytes[0]
+		if c < 0x80 {
+			if i == binary.MaxVarintLen64-1 && c > 1 {
+				return 0, errors.New("varint overflows a 64-bit integer")
+			}
+			this.position += i + 1
+			return value | uint64(c)<<shift, nil
+		}
+		value |= uint64(c&0x7f) << shift
+		shift += 7
+	}
+	return 0, errors.New("varint overflows a 64-bit integer")
+}
+
+func (this *BufferReader) Varint() (int64, error) {
+	value, err := this.Uvarint()
+	if err != nil {
+		return 0, err
+	}
+	result := int64(value >> 1)
+	if value&1 != 0 {
+		result = ^result
+	}
+	return result, nil
+}
+
+func (this *BufferReader) Bytes(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.Errorf("negative length %d", n)
+	}
+	if this.Remaining() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	result := make([]byte, n)
+	if !this.take(result) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return result, nil
+}
+
+func (this *BufferReader) PrefixedBytes() ([]byte, error) {
+	start := this.position
+	length, err := this.Uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(this.max) {
+		this.position = start
+		return nil, errors.Errorf("length %d exceeds limit %d", length, this.max)
+	}
+	result, err := this.Bytes(int(length))
+	if err != nil {
+		this.position = start
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *BufferReader) PrefixedString() (string, error) {
+	result, err := this.PrefixedBytes()
+	return string(result), err
+}
+
+func (this *BufferReader) take(bytes []byte) bool {
+	if !this.copyat(this.position, bytes) {
+		return false
+	}
+	this.position += len(bytes)
+	return true
+}
+
+func (this *BufferReader) copyat(offset int, bytes []byte) bool {
+	if len(bytes) == 0 {
+		return true
+	}
+	source, ok := this.buffer.(*buffer)
+	if !ok {
+		slice, err := this.buffer.Slice(offset, len(bytes))
+		if err != nil {
+			return false
+		}
+		defer slice.Reset()
+		_, err = io.ReadFull(slice, bytes)
+		return err == nil
+	}
+	wrote := 0
+	for cursor := source.read; cursor != nil && wrote < len(bytes); cursor = cursor.next {
+		size := cursor.write - cursor.read
+		if offset >= size {
+			offset -= size
+			continue
+		}
+		wrote += copy(bytes[wrote:], cursor.block.bytes[cursor.read+offset:cursor.write])
+		offset = 0
+	}
+	return wrote == len(bytes)
+}
+
+func NewBufferWriter(buffer Buffer) *BufferWriter {
+	return &BufferWriter{buffer: buffer, order: binary.BigEndian}
+}
+
+func (this *BufferWriter) SetOrder(order binary.ByteOrder) *BufferWriter {
+	this.order = order
+	return this
+}
+
+func (this *BufferWriter) Buffer() Buffer {
+	return this.buffer
+}
+
+func (this *BufferWriter) Uint8(value uint8) error {
+	return this.buffer.WriteByte(value)
+}
+
+func (this *BufferWriter) Uint16(value uint16) error {
+	this.order.PutUint16(this.scratch[:2], value)
+	return this.put(this.scratch[:2])
+}
+
+func (this *BufferWriter) Uint32(value uint32) error {
+	this.order.PutUint32(this.scratch[:4], value)
+	return this.put(this.scratch[:4])
+}
+
+func (this *BufferWriter) Uint64(value uint64) error {
+	this.order.PutUint64(this.scratch[:8], value)
+	return this.put(this.scratch[:8])
+}
+
+func (this *BufferWriter) Int8(value int8) error {
+	return this.Uint8(uint8(value))
+}
+
+func (this *BufferWriter) Int16(value int16) error {
+	return this.Uint16(uint16(value))
+}
+
+func (this *BufferWriter) Int32(value int32) error {
+	return this.Uint32(uint32(value))
+}
+
+func (this *BufferWriter) Int64(value int64) error {
+	return this.Uint64(uint64(value))
+}
+
+func (this *BufferWriter) Float32(value float32) error {
+	return this.Uint32(math.Float32bits(value))
+}
+
+func (this *BufferWriter) Float64(value float64) error {
+	return this.Uint64(math.Float64bits(value))
+}
+
+func (this *BufferWriter) Uvarint(value uint64) error {
+	n := binary.PutUvarint(this.scratch[:], value)
+	return this.put(this.scratch[:n])
+}
+
+func (this *BufferWriter) Varint(value int64) error {
+	n := binary.PutVarint(this.scratch[:], value)
+	return this.put(this.scratch[:n])
+}
+
+func (this *BufferWriter) Bytes(bytes []byte) error {
+	return this.put(bytes)
+}
+
+func (this *BufferWriter) PrefixedBytes(bytes []byte) error {
+	if err := this.Uvarint(uint64(len(bytes))); err != nil {
+		return err
+	}
+	return this.put(bytes)
+}
+
+func (this *BufferWriter) PrefixedString(value string) error {
+	if err := this.Uvarint(uint64(len(value))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(this.buffer, value)
+	return err
+}
+
+func (this *BufferWriter) put(bytes []byte) error {
+	_, err := this.buffer.Write(bytes)
+	return err
+}
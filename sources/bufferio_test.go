@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestBufferReaderWriter(t *testing.T) {
+	pool := NewBufferPool(3)
+	frame := pool.New()
+	writer := NewBufferWriter(frame)
+	writer.Uint16(0xbeef)
+	writer.Int32(-7)
+	writer.Float64(3.5)
+	writer.Varint(-300)
+	writer.Uvarint(1 << 40)
+	writer.PrefixedString("player")
+	writer.SetOrder(binary.LittleEndian).Uint32(0x01020304)
+	size := frame.Len()
+
+	input := pool.New()
+	reader := NewBufferReader(input)
+	parse := func() error {
+		reader.Mark()
+		values := make([]any, 0, 7)
+		for _, read := range []func() (any, error){
+			func() (any, error) { return reader.Uint16() },
+			func() (any, error) { return reader.Int32() },
+			func() (any, error) { return reader.Float64() },
+			func() (any, error) { return reader.Varint() },
+			func() (any, error) { return reader.Uvarint() },
+			func() (any, error) { return reader.PrefixedString() },
+			func() (any, error) { return reader.SetOrder(binary.LittleEndian).Uint32() },
+		} {
+			value, err := read()
+			if err != nil {
+				reader.SetOrder(binary.BigEndian)
+				reader.Rewind()
+				return err
+			}
+			values = append(values, value)
+		}
+		expect := []any{uint16(0xbeef), int32(-7), 3.5, int64(-300), uint64(1 << 40), "player", uint32(0x01020304)}
+		for i := range expect {
+			if values[i] != expect[i] {
+				t.Fatalf("value %d: expect %v, got %v", i, expect[i], values[i])
+			}
+		}
+		return reader.Commit()
+	}
+	for i := 0; i < size; i++ {
+		b, _ := frame.ReadByte()
+		input.WriteByte(b)
+		err := parse()
+		if i < size-1 {
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("byte %d: expect unexpected eof, got %v", i, err)
+			}
+			if input.Len() != i+1 || reader.Position() != 0 {
+				t.Fatalf("byte %d: expect input to be kept", i)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !input.Empty() {
+		t.Fatal("expect input to be consumed")
+	}
+}
+
+func TestBufferReaderHostileLength(t *testing.T) {
+	pool := NewBufferPool(64)
+	frame := pool.New()
+	defer frame.Reset()
+	NewBufferWriter(frame).Uvarint(maxbufferlength)
+	reader := NewBufferReader(frame)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := reader.PrefixedBytes(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect unexpected EOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if after.TotalAlloc-before.TotalAlloc >= maxbufferlength {
+		t.Fatalf("expect no allocation for a truncated payload, got %d bytes", after.TotalAlloc-before.TotalAlloc)
+	}
+	if reader.Position() != 0 {
+		t.Fatalf("expect position restored, got %d", reader.Position())
+	}
+	frame.Reset()
+	NewBufferWriter(frame).Uvarint(maxbufferlength + 1)
+	if _, err := NewBufferReader(frame).PrefixedBytes(); err == nil {
+		t.Fatal("expect default length limit")
+	}
+}
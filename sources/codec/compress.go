@@ -0,0 +1,424 @@
+package codec
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	gerrors "errors"
+	"io"
+	"relay"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+var ErrCompressLimit = gerrors.New("decompressed size exceeds limit")
+
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionDeflate
+	CompressionZstd
+	CompressionLZ4
+)
+
+const (
+	compressFlag     byte = 0x80
+	compressTakeover byte = 0x40
+	compressMask     byte = 0x0f
+)
+
+type CompressOptions struct {
+	compression Compression
+	level       int
+	threshold   int
+	limit       int
+	takeover    bool
+}
+
+func DefaultCompressOptions() CompressOptions {
+	return CompressOptions{compression: CompressionDeflate, level: -1, threshold: 256, limit: defaultFrameSize}
+}
+
+func (this CompressOptions) SetCompression(compression Compression) CompressOptions {
+	this.compression = compression
+	return this
+}
+
+func (this CompressOptions) SetLevel(level int) CompressOptions {
+	this.level = level
+	return this
+}
+
+func (this CompressOptions) SetThreshold(threshold int) CompressOptions {
+	if threshold >= 0 {
+		this.threshold = threshold
+	}
+	return this
+}
+
+func (this CompressOptions) SetLimit(limit int) CompressOptions {
+	if limit > 0 {
+		this.limit = limit
+	}
+	return this
+}
+
+func (this CompressOptions) SetContextTakeover(takeover bool) CompressOptions {
+	this.takeover = takeover
+	return this
+}
+
+func (this Compression) String() string {
+	switch this {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionDeflate:
+		return "deflate"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionLZ4:
+		return "lz4"
+	default:
+		return "none"
+	}
+}
+
+func CompressPipeline(options CompressOptions) Pipeline[relay.Buffer, relay.Buffer] {
+	return &compressPipeline{options: options}
+}
+
+type compressPipeline struct {
+	options CompressOptions
+	writers sync.Pool
+	readers [len(compressors)]sync.Pool
+}
+
+type compressKey struct {
+	pipeline *compressPipeline
+	decode   bool
+}
+
+func (this compressKey) release(value any) {
+	value.(*compressStream).release()
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+type compressor struct {
+	writer func(w io.Writer, level int) (compressWriter, error)
+	reader func(r io.Reader) (io.Reader, error)
+	reset  func(reader io.Reader, r io.Reader) error
+}
+
+var compressors = [...]compressor{
+	CompressionNone: {},
+	CompressionGzip: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		reset: func(reader io.Reader, r io.Reader) error {
+			return reader.(*gzip.Reader).Reset(r)
+		},
+	},
+	CompressionDeflate: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			return flate.NewWriter(w, level)
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return flate.NewReader(r), nil
+		},
+		reset: func(reader io.Reader, r io.Reader) error {
+			return reader.(flate.Resetter).Reset(r, nil)
+		},
+	},
+	CompressionZstd: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			speed := zstd.SpeedDefault
+			if level > 0 {
+				speed = zstd.EncoderLevelFromZstd(level)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		},
+		reset: func(reader io.Reader, r io.Reader) error {
+			return reader.(*zstd.Decoder).Reset(r)
+		},
+	},
+	CompressionLZ4: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			speed := lz4.Fast
+			if level > 0 {
+				if level > 9 {
+					level = 9
+				}
+				speed = lz4.CompressionLevel(1 << (7 + level))
+			}
+			writer := lz4.NewWriter(w)
+			err := writer.Apply(lz4.CompressionLevelOption(speed), lz4.BlockSizeOption(lz4.Block64Kb), lz4.ConcurrencyOption(1))
+			return writer, err
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return lz4.NewReader(r), nil
+		},
+		reset: func(reader io.Reader, r io.Reader) error {
+			reader.(*lz4.Reader).Reset(r)
+			return nil
+		},
+	},
+}
+
+type compressStream struct {
+	compression Compression
+	writer      compressWriter
+	sink        compressSink
+	reader      io.Reader
+	feed        compressFeed
+}
+
+type compressSink struct {
+	target relay.Buffer
+}
+
+type compressFeed struct {
+	source relay.Buffer
+}
+
+func (this *compressStream) release() {
+	if this.feed.source != nil {
+		this.feed.source.Reset()
+	}
+}
+
+func (this *compressSink) Write(bytes []byte) (int, error) {
+	if this.target == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return this.target.Write(bytes)
+}
+
+func (this *compressFeed) Read(bytes []byte) (int, error) {
+	return this.source.Read(bytes)
+}
+
+func (this *compressFeed) ReadByte() (byte, error) {
+	return this.source.ReadByte()
+}
+
+func (this *compressPipeline) Encode(context PipelineContext[relay.Buffer], output relay.Buffer) error {
+	compression := this.options.compression
+	length := output.Len()
+	if compression == CompressionNone || int(compression) >= len(compressors) || length < this.options.threshold {
+		return this.raw(context, output)
+	}
+	buffer := context.Alloc()
+	header := compressFlag | byte(compression)
+	if this.options.takeover {
+		header |= compressTakeover
+	}
+	writer := relay.NewBufferWriter(buffer)
+	err := writer.Uint8(header)
+	if err == nil {
+		err = writer.Uvarint(uint64(length))
+	}
+	if err == nil {
+		if this.options.takeover {
+			err = this.stream(context, buffer, output)
+		} else {
+			err = this.compress(buffer, output.Clone())
+		}
+	}
+	if err != nil {
+		buffer.Reset()
+		output.Reset()
+		return err
+	}
+	if !this.options.takeover && buffer.Len() >= length+1 {
+		buffer.Reset()
+		return this.raw(context, output)
+	}
+	output.Reset()
+	return context.Next(buffer)
+}
+
+func (this *compressPipeline) Decode(context PipelineContext[relay.Buffer], input relay.Buffer) error {
+	header, err := input.ReadByte()
+	if err != nil {
+		input.Reset()
+		return errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	if header&compressFlag == 0 {
+		return context.Next(input)
+	}
+	compression := Compression(header & compressMask)
+	if compression == CompressionNone || int(compression) >= len(compressors) {
+		input.Reset()
+		return errors.Errorf("unknown compression %d", compression)
+	}
+	reader := relay.NewBufferReader(input)
+	length, err := reader.Uvarint()
+	if err != nil {
+		input.Reset()
+		return err
+	}
+	reader.Commit()
+	if length > uint64(this.options.limit) {
+		input.Reset()
+		return errors.Wrapf(ErrCompressLimit, "%s message of %d bytes, limit %d", compression, length, this.options.limit)
+	}
+	buffer := context.Alloc()
+	if header&compressTakeover != 0 {
+		err = this.unstream(context, compression, buffer, input, int64(length))
+	} else {
+		err = this.decompress(compression, buffer, input, int64(length))
+	}
+	input.Reset()
+	if err != nil {
+		buffer.Reset()
+		return err
+	}
+	return context.Next(buffer)
+}
+
+func (this *compressPipeline) raw(context PipelineContext[relay.Buffer], output relay.Buffer) error {
+	buffer := context.Alloc()
+	err := buffer.WriteByte(0)
+	if err == nil {
+		err = buffer.Append(output)
+	}
+	if err != nil {
+		buffer.Reset()
+		output.Reset()
+		return err
+	}
+	return context.Next(buffer)
+}
+
+func (this *compressPipeline) compress(buffer relay.Buffer, output relay.Buffer) error {
+	defer output.Reset()
+	var writer compressWriter
+	if value := this.writers.Get(); value != nil {
+		writer = value.(compressWriter)
+		writer.Reset(buffer)
+	} else {
+		var err error
+		writer, err = compressors[this.options.compression].writer(buffer, this.options.level)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := output.WriteTo(writer)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return err
+	}
+	writer.Reset(nil)
+	this.writers.Put(writer)
+	return nil
+}
+
+func (this *compressPipeline) decompress(compression Compression, buffer relay.Buffer, input relay.Buffer, length int64) error {
+	pool := &this.readers[compression]
+	var reader io.Reader
+	if value := pool.Get(); value != nil {
+		reader = value.(io.Reader)
+		if err := compressors[compression].reset(reader, input); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		reader, err = compressors[compression].reader(input)
+		if err != nil {
+			return err
+		}
+	}
+	if err := this.copy(compression, buffer, reader, length); err != nil {
+		return err
+	}
+	var probe [1]byte
+	n, err := io.ReadFull(reader, probe[:])
+	if n != 0 {
+		return errors.Errorf("%s message has trailing data", compression)
+	}
+	if err != io.EOF {
+		return err
+	}
+	pool.Put(reader)
+	return nil
+}
+
+func (this *compressPipeline) stream(context PipelineContext[relay.Buffer], buffer relay.Buffer, output relay.Buffer) error {
+	key := compressKey{pipeline: this}
+	var state *compressStream
+	if value, ok := context.Load(key); ok {
+		state = value.(*compressStream)
+	} else {
+		state = &compressStream{compression: this.options.compression}
+		writer, err := compressors[state.compression].writer(&state.sink, this.options.level)
+		if err != nil {
+			return err
+		}
+		state.writer = writer
+		context.Store(key, state)
+	}
+	state.sink.target = buffer
+	_, err := output.WriteTo(state.writer)
+	if err == nil {
+		err = state.writer.Flush()
+	}
+	state.sink.target = nil
+	if err != nil {
+		context.Delete(key)
+	}
+	return err
+}
+
+func (this *compressPipeline) unstream(context PipelineContext[relay.Buffer], compression Compression, buffer relay.Buffer, input relay.Buffer, length int64) error {
+	key := compressKey{pipeline: this, decode: true}
+	var state *compressStream
+	if value, ok := context.Load(key); ok {
+		state = value.(*compressStream)
+		if state.compression != compression {
+			context.Delete(key)
+			return errors.Errorf("compression switched from %s to %s within a stream", state.compression, compression)
+		}
+	} else {
+		state = &compressStream{compression: compression}
+		state.feed.source = context.Alloc()
+		context.Store(key, state)
+	}
+	err := state.feed.source.Append(input)
+	if err == nil && state.reader == nil {
+		state.reader, err = compressors[compression].reader(&state.feed)
+	}
+	if err == nil {
+		err = this.copy(compression, buffer, state.reader, length)
+	}
+	if err != nil {
+		state.feed.source.Reset()
+		context.Delete(key)
+	}
+	return err
+}
+
+func (this *compressPipeline) copy(compression Compression, buffer relay.Buffer, reader io.Reader, length int64) error {
+	n, err := io.CopyN(buffer, reader, length)
+	if err == io.EOF {
+		return errors.Errorf("%s message truncated at %d of %d bytes", compression, n, length)
+	}
+	return err
+}
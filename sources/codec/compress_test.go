@@ -0,0 +1,215 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"relay"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+var testpool = relay.NewBufferPool(512)
+
+type testContext struct {
+	values  sync.Map
+	outputs []relay.Buffer
+}
+
+func (this *testContext) Close() error {
+	return nil
+}
+
+func (this *testContext) Load(key any) (any, bool) {
+	return this.values.Load(key)
+}
+
+func (this *testContext) Store(key, value any) {
+	this.values.Store(key, value)
+}
+
+func (this *testContext) Delete(key any) {
+	this.values.Delete(key)
+}
+
+func (this *testContext) Alloc() relay.Buffer {
+	return testpool.New()
+}
+
+func (this *testContext) Next(value relay.Buffer) error {
+	this.outputs = append(this.outputs, value)
+	return nil
+}
+
+func (this *testContext) take() [][]byte {
+	var result [][]byte
+	for _, output := range this.outputs {
+		bytes, _ := io.ReadAll(output)
+		output.Reset()
+		result = append(result, bytes)
+	}
+	this.outputs = nil
+	return result
+}
+
+func testbuffer(bytes []byte) relay.Buffer {
+	buffer := testpool.New()
+	buffer.Write(bytes)
+	return buffer
+}
+
+func teststate(seq int) []byte {
+	var buffer bytes.Buffer
+	for i := 0; i < 64; i++ {
+		fmt.Fprintf(&buffer, "{\"entity\":%d,\"x\":%d,\"y\":%d,\"state\":\"idle\"}", i, i*3+seq, i*7)
+	}
+	return buffer.Bytes()
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	messages := [][]byte{[]byte("ping"), teststate(0), teststate(1), nil, teststate(2)}
+	for _, compression := range []Compression{CompressionGzip, CompressionDeflate, CompressionZstd, CompressionLZ4} {
+		for _, takeover := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/takeover=%v", compression, takeover), func(t *testing.T) {
+				options := DefaultCompressOptions().SetCompression(compression).SetContextTakeover(takeover)
+				pipeline := LinkPipeline[relay.Buffer, relay.Buffer, relay.Buffer](FramePipeline(0), CompressPipeline(options))
+				encoder := &testContext{}
+				for _, message := range messages {
+					if err := pipeline.Encode(encoder, testbuffer(message)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				var wire []byte
+				for _, frame := range encoder.take() {
+					wire = append(wire, frame...)
+				}
+				original := 0
+				for _, message := range messages {
+					original += len(message)
+				}
+				if len(wire)*2 > original {
+					t.Fatalf("wire %d bytes for %d bytes of messages", len(wire), original)
+				}
+				decoder := &testContext{}
+				for len(wire) > 0 {
+					n := 7
+					if n > len(wire) {
+						n = len(wire)
+					}
+					if err := pipeline.Decode(decoder, testbuffer(wire[:n])); err != nil {
+						t.Fatal(err)
+					}
+					wire = wire[n:]
+				}
+				result := decoder.take()
+				if len(result) != len(messages) {
+					t.Fatalf("decoded %d messages, want %d", len(result), len(messages))
+				}
+				for i, message := range messages {
+					if !bytes.Equal(result[i], message) {
+						t.Fatalf("message %d mismatch: %q", i, result[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	pipeline := CompressPipeline(DefaultCompressOptions().SetThreshold(1024))
+	context := &testContext{}
+	if err := pipeline.Encode(context, testbuffer([]byte("short message"))); err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 2048)
+	seed := uint32(1)
+	for i := range random {
+		seed = seed*1664525 + 1013904223
+		random[i] = byte(seed >> 24)
+	}
+	if err := pipeline.Encode(context, testbuffer(random)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.Encode(context, testbuffer(teststate(0))); err != nil {
+		t.Fatal(err)
+	}
+	result := context.take()
+	if result[0][0] != 0 || string(result[0][1:]) != "short message" {
+		t.Fatalf("small message should pass through, got %q", result[0])
+	}
+	if result[1][0] != 0 || !bytes.Equal(result[1][1:], random) {
+		t.Fatalf("incompressible message should pass through")
+	}
+	if result[2][0] != compressFlag|byte(CompressionDeflate) {
+		t.Fatalf("large message header %x", result[2][0])
+	}
+}
+
+func TestCompressLimit(t *testing.T) {
+	encoder := CompressPipeline(DefaultCompressOptions().SetCompression(CompressionZstd))
+	decoder := CompressPipeline(DefaultCompressOptions().SetLimit(1024))
+	context := &testContext{}
+	if err := encoder.Encode(context, testbuffer(teststate(0))); err != nil {
+		t.Fatal(err)
+	}
+	packet := context.take()[0]
+	err := decoder.Decode(context, testbuffer(packet))
+	if errors.Cause(err) != ErrCompressLimit {
+		t.Fatalf("expected limit error, got %v", err)
+	}
+	packet[len(packet)-1] ^= 0xff
+	err = CompressPipeline(DefaultCompressOptions()).Decode(context, testbuffer(packet))
+	if err == nil {
+		t.Fatalf("expected corrupted message to fail")
+	}
+}
+
+type testCloser struct {
+	closed bool
+}
+
+func (this *testCloser) Close() error {
+	this.closed = true
+	return nil
+}
+
+func TestReleasePipelineState(t *testing.T) {
+	pipeline := LinkPipeline[relay.Buffer, relay.Buffer, relay.Buffer](FramePipeline(0), CompressPipeline(DefaultCompressOptions()))
+	context := &testContext{}
+	if err := pipeline.Decode(context, testbuffer([]byte{8, 1, 2})); err != nil {
+		t.Fatal(err)
+	}
+	closer := &testCloser{}
+	buffer := testbuffer([]byte("owned"))
+	context.Store("closer", closer)
+	context.Store("buffer", buffer)
+	var pending relay.Buffer
+	context.values.Range(func(key, value any) bool {
+		if _, ok := key.(frameKey); ok {
+			pending = value.(relay.Buffer)
+		}
+		Release(key, value)
+		return true
+	})
+	if pending == nil || pending.Len() != 0 {
+		t.Fatal("frame state not released")
+	}
+	if closer.closed || buffer.Len() != len("owned") {
+		t.Fatal("handler values released with the pipeline state")
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	pipeline := FramePipeline(16)
+	context := &testContext{}
+	err := pipeline.Encode(context, testbuffer(make([]byte, 17)))
+	if errors.Cause(err) != ErrFrameTooLarge {
+		t.Fatalf("expected frame error, got %v", err)
+	}
+	err = pipeline.Decode(context, testbuffer([]byte{32, 1, 2}))
+	if errors.Cause(err) != ErrFrameTooLarge {
+		t.Fatalf("expected frame error, got %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package codec
 
-import "relay"
+import (
+	"relay"
+)
 
 type Context interface {
 	Close() error
@@ -9,3 +11,13 @@ type Context interface {
 	Delete(key any)
 	Alloc() relay.Buffer
 }
+
+type stateKey interface {
+	release(value any)
+}
+
+func Release(key, value any) {
+	if key, ok := key.(stateKey); ok {
+		key.release(value)
+	}
+}
@@ -0,0 +1,91 @@
+package codec
+
+import (
+	gerrors "errors"
+	"io"
+	"relay"
+
+	"github.com/pkg/errors"
+)
+
+var ErrFrameTooLarge = gerrors.New("frame too large")
+
+const defaultFrameSize = 16 << 20
+
+func FramePipeline(max int) Pipeline[relay.Buffer, relay.Buffer] {
+	if max <= 0 {
+		max = defaultFrameSize
+	}
+	return &framePipeline{max: max}
+}
+
+type framePipeline struct {
+	max int
+}
+
+type frameKey struct {
+	pipeline *framePipeline
+}
+
+func (this frameKey) release(value any) {
+	value.(relay.Buffer).Reset()
+}
+
+func (this *framePipeline) Encode(context PipelineContext[relay.Buffer], output relay.Buffer) error {
+	length := output.Len()
+	if length > this.max {
+		output.Reset()
+		return errors.Wrapf(ErrFrameTooLarge, "encode %d bytes, limit %d", length, this.max)
+	}
+	buffer := context.Alloc()
+	err := relay.NewBufferWriter(buffer).Uvarint(uint64(length))
+	if err == nil {
+		err = buffer.Append(output)
+	}
+	if err != nil {
+		buffer.Reset()
+		output.Reset()
+		return err
+	}
+	return context.Next(buffer)
+}
+
+func (this *framePipeline) Decode(context PipelineContext[relay.Buffer], input relay.Buffer) error {
+	key := frameKey{pipeline: this}
+	var pending relay.Buffer
+	if value, ok := context.Load(key); ok {
+		pending = value.(relay.Buffer)
+	} else {
+		pending = context.Alloc()
+		context.Store(key, pending)
+	}
+	if err := pending.Append(input); err != nil {
+		return err
+	}
+	for {
+		reader := relay.NewBufferReader(pending)
+		length, err := reader.Uvarint()
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err == nil && length > uint64(this.max) {
+			err = errors.Wrapf(ErrFrameTooLarge, "decode %d bytes, limit %d", length, this.max)
+		}
+		if err != nil {
+			pending.Reset()
+			context.Delete(key)
+			return err
+		}
+		if reader.Remaining() < int(length) {
+			return nil
+		}
+		reader.Commit()
+		frame, err := pending.Split(int(length))
+		if err != nil {
+			return err
+		}
+		if err = context.Next(frame); err != nil {
+			return err
+		}
+	}
+}
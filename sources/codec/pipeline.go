@@ -5,6 +5,10 @@ type PipelineContext[TValue any] interface {
 	Next(TValue) error
 }
 
+type Writable[T any] interface {
+	Writer() PipelineContext[T]
+}
+
 type Encoder[TInput, TOutput any] interface {
 	Encode(PipelineContext[TInput], TOutput) error
 }
@@ -42,7 +46,11 @@ func (this *linkPipeline[TInput, TOutput, TBetween]) Encode(context PipelineCont
 }
 
 func (this *linkPipeline[TInput, TOutput, TBetween]) Decode(context PipelineContext[TOutput], input TInput) error {
-	return this.input.Decode(&linkDecodeContext[TOutput, TBetween]{context, this.output}, input)
+	result := &linkDecodeContext[TInput, TOutput, TBetween]{PipelineContext: context, link: this}
+	if writable, ok := context.(Writable[TInput]); ok {
+		result.writer = writable.Writer()
+	}
+	return this.input.Decode(result, input)
 }
 
 type linkEncodeContext[TInput, TOutput any] struct {
@@ -50,15 +58,33 @@ type linkEncodeContext[TInput, TOutput any] struct {
 	next Pipeline[TInput, TOutput]
 }
 
-type linkDecodeContext[TInput, TOutput any] struct {
-	PipelineContext[TInput]
-	next Pipeline[TOutput, TInput]
+type linkDecodeContext[TInput, TOutput, TBetween any] struct {
+	PipelineContext[TOutput]
+	link   *linkPipeline[TInput, TOutput, TBetween]
+	writer PipelineContext[TInput]
+}
+
+type linkWriterContext[TValue, TWriter any] struct {
+	PipelineContext[TValue]
+	writer PipelineContext[TWriter]
 }
 
 func (this *linkEncodeContext[TInput, TOutput]) Next(value TOutput) error {
 	return this.next.Encode(this.PipelineContext, value)
 }
 
-func (this *linkDecodeContext[TInput, TOutput]) Next(value TOutput) error {
-	return this.next.Decode(this.PipelineContext, value)
+func (this *linkDecodeContext[TInput, TOutput, TBetween]) Writer() PipelineContext[TInput] {
+	return this.writer
+}
+
+func (this *linkDecodeContext[TInput, TOutput, TBetween]) Next(value TBetween) error {
+	if this.writer == nil {
+		return this.link.output.Decode(this.PipelineContext, value)
+	}
+	writer := &linkEncodeContext[TInput, TBetween]{this.writer, this.link.input}
+	return this.link.output.Decode(&linkWriterContext[TOutput, TBetween]{this.PipelineContext, writer}, value)
+}
+
+func (this *linkWriterContext[TValue, TWriter]) Writer() PipelineContext[TWriter] {
+	return this.writer
 }
@@ -1,5 +1,9 @@
 package codec
 
+import (
+	"relay"
+)
+
 type RequestContext[TRequest, TResponse any] interface {
 	Context
 	Next(TRequest) (TResponse, error)
@@ -51,3 +55,22 @@ func (this *linkRequestOutContext[TRequest, TResponse, TResult]) Next(value TRes
 	this.result = value
 	return nil
 }
+
+func GuardRequest[TInput, TOutput, TRequest, TResponse any](request Request[TInput, TOutput, TRequest, TResponse], guards ...relay.Guard) Request[TInput, TOutput, TRequest, TResponse] {
+	return &guardRequest[TInput, TOutput, TRequest, TResponse]{request: request, guards: guards}
+}
+
+type guardRequest[TInput, TOutput, TRequest, TResponse any] struct {
+	request Request[TInput, TOutput, TRequest, TResponse]
+	guards  []relay.Guard
+}
+
+func (this *guardRequest[TInput, TOutput, TRequest, TResponse]) Call(context RequestContext[TRequest, TResponse], request TInput) (TOutput, error) {
+	var result TOutput
+	err := relay.Guarded(this.guards, func() error {
+		var err error
+		result, err = this.request.Call(context, request)
+		return err
+	})
+	return result, err
+}
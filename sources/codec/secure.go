@@ -0,0 +1,602 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	gerrors "errors"
+	"io"
+	"math"
+	"relay"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrSecureHandshake = gerrors.New("secure handshake failed")
+var ErrSecureTimeout = gerrors.New("secure handshake timeout")
+var ErrSecureAuth = gerrors.New("secure frame authentication failed")
+var ErrSecureReplay = gerrors.New("secure frame replayed")
+
+type Cipher byte
+
+const (
+	CipherAESGCM Cipher = iota + 1
+	CipherChaCha20Poly1305
+)
+
+const (
+	secureHello byte = 0x01
+	secureData  byte = 0x02
+	secureEarly byte = 0x03
+)
+
+const (
+	secureHelloSize  = 2 + curve25519.PointSize + 8
+	secureHeaderSize = 1 + 8
+	secureWindow     = 64
+	secureEarlyData  = 16 << 10
+)
+
+type SecureOptions struct {
+	cipher     Cipher
+	privateKey []byte
+	peerKey    []byte
+	timeout    time.Duration
+	skew       time.Duration
+	early      int
+	replay     SecureReplayStore
+}
+
+type SecureReplayStore interface {
+	Remember(key []byte, expire time.Time) bool
+}
+
+func DefaultSecureOptions() SecureOptions {
+	return SecureOptions{cipher: CipherAESGCM, timeout: time.Second * 10, skew: time.Minute * 2, early: secureEarlyData}
+}
+
+func (this SecureOptions) SetCipher(cipher Cipher) SecureOptions {
+	this.cipher = cipher
+	return this
+}
+
+func (this SecureOptions) SetPrivateKey(key []byte) SecureOptions {
+	this.privateKey = key
+	return this
+}
+
+func (this SecureOptions) SetPeerKey(key []byte) SecureOptions {
+	this.peerKey = key
+	return this
+}
+
+func (this SecureOptions) SetHandshakeTimeout(timeout time.Duration) SecureOptions {
+	if timeout > 0 {
+		this.timeout = timeout
+	}
+	return this
+}
+
+func (this SecureOptions) SetEarlyData(size int) SecureOptions {
+	if size >= 0 {
+		this.early = size
+	}
+	return this
+}
+
+func (this SecureOptions) SetClockSkew(skew time.Duration) SecureOptions {
+	if skew > 0 {
+		this.skew = skew
+	}
+	return this
+}
+
+// SetReplayStore replaces the in-memory hello cache, which is lost on restart; only a persistent store rejects hellos replayed across restarts.
+func (this SecureOptions) SetReplayStore(store SecureReplayStore) SecureOptions {
+	this.replay = store
+	return this
+}
+
+func (this Cipher) String() string {
+	switch this {
+	case CipherAESGCM:
+		return "aes-gcm"
+	case CipherChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return "unknown"
+	}
+}
+
+func GenerateSecureKey() (privateKey []byte, publicKey []byte, err error) {
+	privateKey = make([]byte, curve25519.ScalarSize)
+	if _, err = io.ReadFull(rand.Reader, privateKey); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	publicKey, err = curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return privateKey, publicKey, nil
+}
+
+func SecurePipeline(options SecureOptions) Pipeline[relay.Buffer, relay.Buffer] {
+	pipeline := &securePipeline{options: options}
+	if pipeline.options.replay == nil {
+		pipeline.options.replay = &secureReplayMemory{seen: make(map[string]time.Time)}
+	}
+	if len(options.peerKey) == 0 && len(options.privateKey) != 0 {
+		pipeline.publicKey, pipeline.err = curve25519.X25519(options.privateKey, curve25519.Basepoint)
+	} else if len(options.peerKey) == 0 {
+		pipeline.err = errors.New("secure pipeline needs a private key or a peer key")
+	}
+	return pipeline
+}
+
+type securePipeline struct {
+	options   SecureOptions
+	publicKey []byte
+	err       error
+	guard     sync.Mutex
+}
+
+type secureKey struct {
+	pipeline *securePipeline
+}
+
+func (this secureKey) release(value any) {
+	value.(*secureSession).release()
+}
+
+type secureSession struct {
+	guard     sync.Mutex
+	ephemeral []byte
+	public    []byte
+	stamp     [8]byte
+	err       error
+	hello     bool
+	received  bool
+	earlySent int
+	earlyRead int
+	pending   []relay.Buffer
+	output    PipelineContext[relay.Buffer]
+	timer     *time.Timer
+	early     secureDirection
+	send      secureDirection
+	receive   secureDirection
+}
+
+type secureDirection struct {
+	aead    cipher.AEAD
+	iv      [12]byte
+	counter uint64
+	highest uint64
+	window  uint64
+	scratch []byte
+}
+
+type secureReplayMemory struct {
+	guard  sync.Mutex
+	seen   map[string]time.Time
+	purged time.Time
+}
+
+func (this *securePipeline) Encode(context PipelineContext[relay.Buffer], output relay.Buffer) error {
+	session, err := this.session(context)
+	if err != nil {
+		output.Reset()
+		return err
+	}
+	session.guard.Lock()
+	defer session.guard.Unlock()
+	if session.err != nil {
+		output.Reset()
+		return session.err
+	}
+	if !this.initiator() && !session.received {
+		this.queue(session, context, output)
+		return nil
+	}
+	if err = this.hello(session, context); err != nil {
+		output.Reset()
+		return err
+	}
+	if this.initiator() && !session.received {
+		if len(session.pending) != 0 || session.earlySent+output.Len() > this.options.early {
+			this.queue(session, context, output)
+			return nil
+		}
+		session.earlySent += output.Len()
+	}
+	return this.seal(session, context, output)
+}
+
+func (this *securePipeline) Decode(context PipelineContext[relay.Buffer], input relay.Buffer) error {
+	defer input.Reset()
+	session, err := this.session(context)
+	if err != nil {
+		return err
+	}
+	session.guard.Lock()
+	defer session.guard.Unlock()
+	kind, err := input.ReadByte()
+	if err != nil {
+		return errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	if kind == secureHello {
+		return this.accept(session, context, input)
+	}
+	var receive *secureDirection
+	switch {
+	case kind == secureData:
+		receive = &session.receive
+	case kind == secureEarly && !this.initiator():
+		receive = &session.early
+	default:
+		return errors.Wrapf(ErrSecureHandshake, "unknown frame type %d", kind)
+	}
+	if session.err != nil {
+		return session.err
+	}
+	if !session.received {
+		return errors.Wrap(ErrSecureHandshake, "data before hello")
+	}
+	length := input.Len()
+	if length < 8+receive.aead.Overhead() {
+		return errors.Wrap(ErrSecureAuth, "frame too short")
+	}
+	scratch := receive.buffer(1 + length)
+	scratch[0] = kind
+	if _, err = io.ReadFull(input, scratch[1:]); err != nil {
+		return err
+	}
+	counter := binary.BigEndian.Uint64(scratch[1:secureHeaderSize])
+	if !receive.check(counter) {
+		return errors.Wrapf(ErrSecureReplay, "counter %d", counter)
+	}
+	nonce := receive.nonce(counter)
+	plain, err := receive.aead.Open(scratch[secureHeaderSize:secureHeaderSize], nonce[:], scratch[secureHeaderSize:], scratch[:secureHeaderSize])
+	if err != nil {
+		return errors.WithStack(ErrSecureAuth)
+	}
+	receive.accept(counter)
+	if receive == &session.early {
+		session.earlyRead += len(plain)
+		if session.earlyRead > this.options.early {
+			return session.fail(errors.Wrapf(ErrSecureHandshake, "early data exceeds %d bytes", this.options.early))
+		}
+	}
+	buffer := context.Alloc()
+	if _, err = buffer.Write(plain); err != nil {
+		buffer.Reset()
+		return err
+	}
+	return context.Next(buffer)
+}
+
+func (this *securePipeline) initiator() bool {
+	return len(this.options.peerKey) != 0
+}
+
+func (this *securePipeline) session(context Context) (*secureSession, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	key := secureKey{pipeline: this}
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if value, ok := context.Load(key); ok {
+		return value.(*secureSession), nil
+	}
+	ephemeral, public, err := GenerateSecureKey()
+	if err != nil {
+		return nil, err
+	}
+	session := &secureSession{ephemeral: ephemeral, public: public}
+	binary.BigEndian.PutUint64(session.stamp[:], uint64(relay.Now().UnixNano()))
+	context.Store(key, session)
+	return session, nil
+}
+
+func (this *securePipeline) queue(session *secureSession, context PipelineContext[relay.Buffer], output relay.Buffer) {
+	session.pending = append(session.pending, output)
+	session.output = context
+	this.arm(session)
+}
+
+func (this *securePipeline) arm(session *secureSession) {
+	if session.timer == nil {
+		session.timer = time.AfterFunc(this.options.timeout, func() {
+			session.guard.Lock()
+			defer session.guard.Unlock()
+			if !session.received {
+				session.fail(errors.WithStack(ErrSecureTimeout))
+			}
+		})
+	}
+}
+
+func (this *securePipeline) flush(session *secureSession, context PipelineContext[relay.Buffer]) error {
+	pending := session.pending
+	session.pending, session.output = nil, nil
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+	if context == nil {
+		return nil
+	}
+	err := this.hello(session, context)
+	for i, output := range pending {
+		if err != nil {
+			for _, output := range pending[i:] {
+				output.Reset()
+			}
+			break
+		}
+		err = this.seal(session, context, output)
+	}
+	return err
+}
+
+func (this *securePipeline) hello(session *secureSession, context PipelineContext[relay.Buffer]) error {
+	if session.hello {
+		return nil
+	}
+	if this.initiator() {
+		if err := this.initiate(session); err != nil {
+			return err
+		}
+		this.arm(session)
+	}
+	hello := context.Alloc()
+	writer := relay.NewBufferWriter(hello)
+	writer.Uint8(secureHello)
+	writer.Uint8(byte(this.options.cipher))
+	writer.Bytes(session.public)
+	if err := writer.Bytes(session.stamp[:]); err != nil {
+		hello.Reset()
+		return err
+	}
+	session.hello = true
+	return context.Next(hello)
+}
+
+func (this *securePipeline) seal(session *secureSession, context PipelineContext[relay.Buffer], output relay.Buffer) error {
+	send, kind := &session.send, secureData
+	if this.initiator() && !session.received {
+		send, kind = &session.early, secureEarly
+	}
+	if send.counter == math.MaxUint64 {
+		output.Reset()
+		return errors.New("secure nonce space exhausted")
+	}
+	length := output.Len()
+	scratch := send.buffer(secureHeaderSize + length + send.aead.Overhead())
+	scratch[0] = kind
+	binary.BigEndian.PutUint64(scratch[1:secureHeaderSize], send.counter)
+	_, err := io.ReadFull(output, scratch[secureHeaderSize:secureHeaderSize+length])
+	output.Reset()
+	if err != nil {
+		return err
+	}
+	nonce := send.nonce(send.counter)
+	sealed := send.aead.Seal(scratch[:secureHeaderSize], nonce[:], scratch[secureHeaderSize:secureHeaderSize+length], scratch[:secureHeaderSize])
+	send.counter++
+	buffer := context.Alloc()
+	if _, err = buffer.Write(sealed); err != nil {
+		buffer.Reset()
+		return err
+	}
+	return context.Next(buffer)
+}
+
+func (this *securePipeline) initiate(session *secureSession) error {
+	es, err := curve25519.X25519(session.ephemeral, this.options.peerKey)
+	if err != nil {
+		return errors.Wrap(ErrSecureHandshake, err.Error())
+	}
+	transcript := secureTranscript(session.public, this.options.peerKey, session.stamp[:])
+	return session.early.init(this.options.cipher, es, "relay secure early", transcript)
+}
+
+func (this *securePipeline) accept(session *secureSession, context PipelineContext[relay.Buffer], input relay.Buffer) error {
+	if session.err != nil {
+		return session.err
+	}
+	if session.received {
+		return errors.Wrap(ErrSecureHandshake, "duplicate hello")
+	}
+	var hello [secureHelloSize - 1]byte
+	if _, err := io.ReadFull(input, hello[:]); err != nil || !input.Empty() {
+		return session.fail(errors.Wrap(ErrSecureHandshake, "malformed hello"))
+	}
+	suite := Cipher(hello[0])
+	peer := hello[1 : 1+curve25519.PointSize]
+	stamp := hello[1+curve25519.PointSize:]
+	if this.initiator() {
+		if !session.hello {
+			return session.fail(errors.Wrap(ErrSecureHandshake, "hello before initiation"))
+		}
+		ee, err := curve25519.X25519(session.ephemeral, peer)
+		if err != nil {
+			return session.fail(errors.Wrap(ErrSecureHandshake, err.Error()))
+		}
+		es, err := curve25519.X25519(session.ephemeral, this.options.peerKey)
+		if err != nil {
+			return session.fail(errors.Wrap(ErrSecureHandshake, err.Error()))
+		}
+		transcript := secureTranscript(session.public, this.options.peerKey, session.stamp[:], peer)
+		if err = session.send.init(this.options.cipher, append(es, ee...), "relay secure i2r", transcript); err != nil {
+			return session.fail(err)
+		}
+		if err = session.receive.init(suite, append(es, ee...), "relay secure r2i", transcript); err != nil {
+			return session.fail(err)
+		}
+		session.received = true
+		return this.flush(session, session.output)
+	}
+	if err := this.fresh(peer, stamp); err != nil {
+		return session.fail(err)
+	}
+	es, err := curve25519.X25519(this.options.privateKey, peer)
+	if err != nil {
+		return session.fail(errors.Wrap(ErrSecureHandshake, err.Error()))
+	}
+	ee, err := curve25519.X25519(session.ephemeral, peer)
+	if err != nil {
+		return session.fail(errors.Wrap(ErrSecureHandshake, err.Error()))
+	}
+	transcript := secureTranscript(peer, this.publicKey, stamp)
+	if err = session.early.init(suite, es, "relay secure early", transcript); err != nil {
+		return session.fail(err)
+	}
+	transcript = secureTranscript(peer, this.publicKey, stamp, session.public)
+	if err = session.receive.init(suite, append(es, ee...), "relay secure i2r", transcript); err != nil {
+		return session.fail(err)
+	}
+	if err = session.send.init(this.options.cipher, append(es, ee...), "relay secure r2i", transcript); err != nil {
+		return session.fail(err)
+	}
+	session.received = true
+	output := session.output
+	if writable, ok := context.(Writable[relay.Buffer]); ok && writable.Writer() != nil {
+		output = writable.Writer()
+	}
+	return this.flush(session, output)
+}
+
+func (this *securePipeline) fresh(peer []byte, stamp []byte) error {
+	now := relay.Now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(stamp)))
+	if sent.Before(now.Add(-this.options.skew)) || sent.After(now.Add(this.options.skew)) {
+		return errors.Wrapf(ErrSecureReplay, "hello stamped %v outside clock skew", sent)
+	}
+	if !this.options.replay.Remember(peer, now.Add(this.options.skew*2)) {
+		return errors.Wrap(ErrSecureReplay, "hello already seen")
+	}
+	return nil
+}
+
+func (this *secureSession) fail(err error) error {
+	if this.err == nil {
+		this.err = err
+		for _, output := range this.pending {
+			output.Reset()
+		}
+		this.pending, this.output = nil, nil
+	}
+	this.received = true
+	return err
+}
+
+func (this *secureSession) release() {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if this.timer != nil {
+		this.timer.Stop()
+	}
+	for _, output := range this.pending {
+		output.Reset()
+	}
+	this.pending, this.output = nil, nil
+}
+
+func (this *secureReplayMemory) Remember(key []byte, expire time.Time) bool {
+	now := relay.Now()
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if now.After(this.purged) {
+		for seen, at := range this.seen {
+			if now.After(at) {
+				delete(this.seen, seen)
+			}
+		}
+		this.purged = now.Add(expire.Sub(now) / 2)
+	}
+	if at, ok := this.seen[string(key)]; ok && !now.After(at) {
+		return false
+	}
+	this.seen[string(key)] = expire
+	return true
+}
+
+func (this *secureDirection) init(suite Cipher, secret []byte, label string, transcript []byte) error {
+	material := make([]byte, 32+len(this.iv))
+	info := append([]byte(label), byte(suite))
+	info = append(info, transcript...)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), material); err != nil {
+		return errors.WithStack(err)
+	}
+	var err error
+	switch suite {
+	case CipherAESGCM:
+		var block cipher.Block
+		block, err = aes.NewCipher(material[:32])
+		if err == nil {
+			this.aead, err = cipher.NewGCM(block)
+		}
+	case CipherChaCha20Poly1305:
+		this.aead, err = chacha20poly1305.New(material[:32])
+	default:
+		return errors.Wrapf(ErrSecureHandshake, "unsupported cipher %d", suite)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	copy(this.iv[:], material[32:])
+	return nil
+}
+
+func (this *secureDirection) nonce(counter uint64) [12]byte {
+	nonce := this.iv
+	for i := 0; i < 8; i++ {
+		nonce[4+i] ^= byte(counter >> (56 - 8*i))
+	}
+	return nonce
+}
+
+func (this *secureDirection) buffer(size int) []byte {
+	if cap(this.scratch) < size {
+		this.scratch = make([]byte, size)
+	}
+	return this.scratch[:size]
+}
+
+func (this *secureDirection) check(counter uint64) bool {
+	if this.window == 0 || counter > this.highest {
+		return true
+	}
+	offset := this.highest - counter
+	return offset < secureWindow && this.window&(1<<offset) == 0
+}
+
+func (this *secureDirection) accept(counter uint64) {
+	if this.window == 0 || counter > this.highest {
+		shift := counter - this.highest
+		if this.window == 0 {
+			this.window = 1
+		} else if shift >= secureWindow {
+			this.window = 1
+		} else {
+			this.window = this.window<<shift | 1
+		}
+		this.highest = counter
+		return
+	}
+	this.window |= 1 << (this.highest - counter)
+}
+
+func secureTranscript(parts ...[]byte) []byte {
+	var result []byte
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
@@ -0,0 +1,333 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"relay"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func securepair(t *testing.T, cipher Cipher) (Pipeline[relay.Buffer, relay.Buffer], Pipeline[relay.Buffer, relay.Buffer]) {
+	private, public, err := GenerateSecureKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := SecurePipeline(DefaultSecureOptions().SetCipher(cipher).SetPeerKey(public))
+	server := SecurePipeline(DefaultSecureOptions().SetCipher(cipher).SetPrivateKey(private))
+	return client, server
+}
+
+func securesend(t *testing.T, pipeline Pipeline[relay.Buffer, relay.Buffer], context *testContext, messages ...string) [][]byte {
+	for _, message := range messages {
+		if err := pipeline.Encode(context, testbuffer([]byte(message))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return context.take()
+}
+
+func securereceive(pipeline Pipeline[relay.Buffer, relay.Buffer], context *testContext, frames [][]byte) ([]string, error) {
+	for _, frame := range frames {
+		if err := pipeline.Decode(context, testbuffer(frame)); err != nil {
+			return nil, err
+		}
+	}
+	var result []string
+	for _, message := range context.take() {
+		result = append(result, string(message))
+	}
+	return result, nil
+}
+
+type testForward struct {
+	*testContext
+	next *testContext
+}
+
+func (this *testForward) Next(value relay.Buffer) error {
+	return this.next.Next(value)
+}
+
+type testWritable struct {
+	*testContext
+	writer *testContext
+}
+
+func (this *testWritable) Writer() PipelineContext[relay.Buffer] {
+	return this.writer
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	for _, cipher := range []Cipher{CipherAESGCM, CipherChaCha20Poly1305} {
+		t.Run(cipher.String(), func(t *testing.T) {
+			client, server := securepair(t, cipher)
+			clientcontext, servercontext := &testContext{}, &testContext{}
+			frames := securesend(t, client, clientcontext, "hello", "", "world")
+			if len(frames) != 4 || frames[0][0] != secureHello {
+				t.Fatalf("expected hello and three data frames, got %d", len(frames))
+			}
+			if bytes.Contains(frames[1], []byte("hello")) {
+				t.Fatalf("payload sent in cleartext")
+			}
+			result, err := securereceive(server, servercontext, frames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(result) != "[hello  world]" {
+				t.Fatalf("server received %q", result)
+			}
+			result, err = securereceive(client, clientcontext, securesend(t, server, servercontext, "welcome"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(result) != "[welcome]" {
+				t.Fatalf("client received %q", result)
+			}
+			frames = securesend(t, client, clientcontext, "again")
+			if len(frames) != 1 || frames[0][0] != secureData {
+				t.Fatalf("expected data frame after handshake, got %v", frames)
+			}
+			result, err = securereceive(server, servercontext, frames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(result) != "[again]" {
+				t.Fatalf("server received %q", result)
+			}
+		})
+	}
+}
+
+func TestSecureTamperAndReplay(t *testing.T) {
+	client, server := securepair(t, CipherAESGCM)
+	frames := securesend(t, client, &testContext{}, "first", "second")
+	context := &testContext{}
+	if _, err := securereceive(server, context, frames[:2]); err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), frames[2]...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := securereceive(server, context, [][]byte{tampered}); errors.Cause(err) != ErrSecureAuth {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+	if _, err := securereceive(server, context, [][]byte{frames[1]}); errors.Cause(err) != ErrSecureReplay {
+		t.Fatalf("expected replay error, got %v", err)
+	}
+	if _, err := securereceive(server, context, frames[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := securereceive(server, &testContext{}, frames); errors.Cause(err) != ErrSecureReplay {
+		t.Fatalf("expected replayed session to be rejected, got %v", err)
+	}
+}
+
+func TestSecureWrongKey(t *testing.T) {
+	_, other, err := GenerateSecureKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, server := securepair(t, CipherChaCha20Poly1305)
+	client := SecurePipeline(DefaultSecureOptions().SetPeerKey(other))
+	frames := securesend(t, client, &testContext{}, "secret")
+	if _, err = securereceive(server, &testContext{}, frames); errors.Cause(err) != ErrSecureAuth {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+func TestSecureHandshakeTimeout(t *testing.T) {
+	private, _, err := GenerateSecureKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := SecurePipeline(DefaultSecureOptions().SetPrivateKey(private).SetHandshakeTimeout(time.Millisecond * 20))
+	context := &testContext{}
+	if err = server.Encode(context, testbuffer([]byte("early"))); err != nil {
+		t.Fatalf("expected output to be queued, got %v", err)
+	}
+	if len(context.outputs) != 0 {
+		t.Fatal("expected nothing sent before the handshake")
+	}
+	time.Sleep(time.Millisecond * 50)
+	err = server.Encode(context, testbuffer([]byte("late")))
+	if errors.Cause(err) != ErrSecureTimeout {
+		t.Fatalf("expected handshake timeout, got %v", err)
+	}
+}
+
+func TestSecureResponderQueue(t *testing.T) {
+	client, server := securepair(t, CipherAESGCM)
+	clientcontext, serveroutput, received := &testContext{}, &testContext{}, &testContext{}
+	frames := securesend(t, server, serveroutput, "queued", "twice")
+	if len(frames) != 0 {
+		t.Fatalf("expected server output to wait for the handshake, got %d frames", len(frames))
+	}
+	for _, frame := range securesend(t, client, clientcontext, "hi") {
+		if err := server.Decode(&testForward{serveroutput, received}, testbuffer(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result := received.take(); len(result) != 1 || string(result[0]) != "hi" {
+		t.Fatalf("server received %q", result)
+	}
+	frames = serveroutput.take()
+	if len(frames) != 3 || frames[0][0] != secureHello {
+		t.Fatalf("expected hello and queued frames after the handshake, got %d", len(frames))
+	}
+	result, err := securereceive(client, clientcontext, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result) != "[queued twice]" {
+		t.Fatalf("client received %q", result)
+	}
+}
+
+func TestSecureEarlyKey(t *testing.T) {
+	client, server := securepair(t, CipherAESGCM)
+	clientcontext, servercontext := &testContext{}, &testContext{}
+	frames := securesend(t, client, clientcontext, "early")
+	if frames[1][0] != secureEarly {
+		t.Fatalf("expected early frame before the handshake, got %d", frames[1][0])
+	}
+	if _, err := securereceive(server, servercontext, frames); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := securereceive(client, clientcontext, securesend(t, server, servercontext, "ack")); err != nil {
+		t.Fatal(err)
+	}
+	forged := append([]byte(nil), frames[1]...)
+	forged[0] = secureData
+	if _, err := securereceive(server, servercontext, [][]byte{forged}); errors.Cause(err) != ErrSecureAuth {
+		t.Fatalf("expected early key to be rejected for session data, got %v", err)
+	}
+	forged = securesend(t, client, clientcontext, "late", "later")[1]
+	forged[0] = secureEarly
+	if _, err := securereceive(server, servercontext, [][]byte{forged}); errors.Cause(err) != ErrSecureAuth {
+		t.Fatalf("expected session key to differ from early key, got %v", err)
+	}
+}
+
+func TestSecureLinked(t *testing.T) {
+	private, public, err := GenerateSecureKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := func(options SecureOptions) Pipeline[relay.Buffer, relay.Buffer] {
+		return LinkPipeline[relay.Buffer, relay.Buffer, relay.Buffer](FramePipeline(0),
+			LinkPipeline[relay.Buffer, relay.Buffer, relay.Buffer](SecurePipeline(options), CompressPipeline(DefaultCompressOptions())))
+	}
+	client := stack(DefaultSecureOptions().SetPeerKey(public))
+	server := stack(DefaultSecureOptions().SetPrivateKey(private))
+	var wire []byte
+	clientcontext := &testContext{}
+	for _, frame := range securesend(t, client, clientcontext, string(teststate(0)), "ping") {
+		wire = append(wire, frame...)
+	}
+	context, reply := &testContext{}, &testContext{}
+	for len(wire) > 0 {
+		n := 100
+		if n > len(wire) {
+			n = len(wire)
+		}
+		if err = server.Decode(&testWritable{context, reply}, testbuffer(wire[:n])); err != nil {
+			t.Fatal(err)
+		}
+		wire = wire[n:]
+	}
+	result := context.take()
+	if len(result) != 2 || !bytes.Equal(result[0], teststate(0)) || string(result[1]) != "ping" {
+		t.Fatalf("unexpected messages %d", len(result))
+	}
+	hello := reply.take()
+	if len(hello) != 1 {
+		t.Fatalf("expected one framed responder hello, got %d", len(hello))
+	}
+	if err = client.Decode(clientcontext, testbuffer(hello[0])); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecureResponderHello(t *testing.T) {
+	client, server := securepair(t, CipherAESGCM)
+	clientcontext, serverinput, serveroutput := &testContext{}, &testContext{}, &testContext{}
+	frames := securesend(t, client, clientcontext, "hi")
+	for _, frame := range frames {
+		if err := server.Decode(&testWritable{serverinput, serveroutput}, testbuffer(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hello := serveroutput.take()
+	if len(hello) != 1 || hello[0][0] != secureHello {
+		t.Fatalf("expected responder hello without application data, got %d frames", len(hello))
+	}
+	if _, err := securereceive(client, clientcontext, hello); err != nil {
+		t.Fatal(err)
+	}
+	frames = securesend(t, client, clientcontext, "after")
+	if len(frames) != 1 || frames[0][0] != secureData {
+		t.Fatalf("expected session key after the responder hello, got %v", frames)
+	}
+}
+
+func TestSecureEarlyDataLimit(t *testing.T) {
+	private, public, err := GenerateSecureKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := SecurePipeline(DefaultSecureOptions().SetPeerKey(public).SetEarlyData(8))
+	server := SecurePipeline(DefaultSecureOptions().SetPrivateKey(private).SetEarlyData(8))
+	clientcontext, servercontext := &testContext{}, &testContext{}
+	frames := securesend(t, client, clientcontext, "12345678", "queued")
+	if len(frames) != 2 || frames[1][0] != secureEarly {
+		t.Fatalf("expected hello and one early frame, got %d", len(frames))
+	}
+	result, err := securereceive(server, servercontext, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result) != "[12345678]" {
+		t.Fatalf("server received %q", result)
+	}
+	received := &testContext{}
+	for _, frame := range securesend(t, server, servercontext, "ack") {
+		if err = client.Decode(&testForward{clientcontext, received}, testbuffer(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result := received.take(); len(result) != 1 || string(result[0]) != "ack" {
+		t.Fatalf("client received %q", result)
+	}
+	frames = clientcontext.take()
+	if len(frames) != 1 || frames[0][0] != secureData {
+		t.Fatalf("expected queued output flushed with the session key, got %d", len(frames))
+	}
+	result, err = securereceive(server, servercontext, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result) != "[queued]" {
+		t.Fatalf("server received %q", result)
+	}
+	greedy := SecurePipeline(DefaultSecureOptions().SetPeerKey(public).SetEarlyData(64))
+	frames = securesend(t, greedy, &testContext{}, "12345678", "9")
+	if _, err = securereceive(server, &testContext{}, frames); errors.Cause(err) != ErrSecureHandshake {
+		t.Fatalf("expected early data limit error, got %v", err)
+	}
+}
+
+func TestSecureInitiatorTimeout(t *testing.T) {
+	_, public, err := GenerateSecureKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := SecurePipeline(DefaultSecureOptions().SetPeerKey(public).SetHandshakeTimeout(time.Millisecond * 20))
+	context := &testContext{}
+	securesend(t, client, context, "early")
+	time.Sleep(time.Millisecond * 50)
+	if err = client.Encode(context, testbuffer([]byte("late"))); errors.Cause(err) != ErrSecureTimeout {
+		t.Fatalf("expected handshake timeout, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+type MissedPolicy int
+
+const (
+	MissedSkip MissedPolicy = iota
+	MissedRunOnce
+	MissedRunAll
+)
+
+type CronSchedule struct {
+	schedule cron.Schedule
+	jitter   time.Duration
+	missed   MissedPolicy
+	since    time.Time
+}
+
+func WithCron(spec string) (TimerSchedule, error) {
+	return NewCron(spec)
+}
+
+func NewCron(spec string) (*CronSchedule, error) {
+	schedule, err := cronparser.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &CronSchedule{schedule: schedule, missed: MissedSkip}, nil
+}
+
+func (this *CronSchedule) In(location *time.Location) *CronSchedule {
+	if spec, ok := this.schedule.(*cron.SpecSchedule); ok && location != nil {
+		spec.Location = location
+	}
+	return this
+}
+
+func (this *CronSchedule) SetJitter(jitter time.Duration) *CronSchedule {
+	if jitter >= 0 {
+		this.jitter = jitter
+	}
+	return this
+}
+
+func (this *CronSchedule) SetMissed(policy MissedPolicy) *CronSchedule {
+	this.missed = policy
+	return this
+}
+
+func (this *CronSchedule) Since(last time.Time) *CronSchedule {
+	this.since = last
+	return this
+}
+
+func (this *CronSchedule) Next(now time.Time) time.Time {
+	_, next := this.Plan(time.Time{}, now)
+	return next
+}
+
+func (this *CronSchedule) Plan(last, now time.Time) (time.Time, time.Time) {
+	if last.IsZero() {
+		last = this.since
+	}
+	if last.IsZero() {
+		last = now
+	}
+	next := this.schedule.Next(last)
+	if next.IsZero() {
+		return next, next
+	}
+	if !next.After(now) {
+		switch this.missed {
+		case MissedRunAll:
+			return next, next
+		case MissedRunOnce:
+			return now, now
+		default:
+			next = this.schedule.Next(now)
+			if next.IsZero() {
+				return next, next
+			}
+		}
+	}
+	planned := next
+	if this.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(this.jitter))))
+	}
+	return planned, next
+}
+
+var cronparser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
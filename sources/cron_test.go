@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronSeconds(t *testing.T) {
+	schedule, err := NewCron("*/15 * * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 1, 1, 0, 0, 1, 0, time.UTC)
+	next := schedule.Next(now)
+	if !next.Equal(now.Add(time.Second * 14)) {
+		t.Fatalf("expect %v, got %v", now.Add(time.Second*14), next)
+	}
+}
+
+func TestCronLocation(t *testing.T) {
+	location, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	expect := time.Date(2022, 1, 2, 4, 0, 0, 0, location)
+	schedule, err := NewCron("CRON_TZ=Asia/Shanghai 0 4 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.Next(now); !next.Equal(expect) {
+		t.Fatalf("expect %v, got %v", expect, next)
+	}
+	schedule, err = NewCron("0 4 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.In(location).Next(now); !next.Equal(expect) {
+		t.Fatalf("expect %v, got %v", expect, next)
+	}
+}
+
+func TestCronMissed(t *testing.T) {
+	last := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := last.Add(time.Hour*72 + time.Minute)
+	expects := map[MissedPolicy][]time.Time{
+		MissedSkip:    {last.Add(time.Hour * 96)},
+		MissedRunOnce: {now, last.Add(time.Hour * 96)},
+		MissedRunAll:  {last.Add(time.Hour * 24), last.Add(time.Hour * 48), last.Add(time.Hour * 72), last.Add(time.Hour * 96)},
+	}
+	for policy, times := range expects {
+		schedule, err := NewCron("0 0 * * *")
+		if err != nil {
+			t.Fatal(err)
+		}
+		schedule.In(time.UTC).Since(last).SetMissed(policy)
+		for i := 0; i < 2; i++ {
+			if next := schedule.Next(now); !next.Equal(times[0]) {
+				t.Fatalf("policy %d: expect Next to stay %v, got %v", policy, times[0], next)
+			}
+		}
+		var planned time.Time
+		for i, expect := range times {
+			var next time.Time
+			planned, next = schedule.Plan(planned, now)
+			if !next.Equal(expect) {
+				t.Fatalf("policy %d run %d: expect %v, got %v", policy, i, expect, next)
+			}
+		}
+	}
+}
+
+func TestCronJitter(t *testing.T) {
+	schedule, err := NewCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule.SetJitter(time.Minute)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 24; i++ {
+		next := schedule.Next(now)
+		planned := now.Truncate(time.Hour).Add(time.Hour)
+		if next.Before(planned) || !next.Before(planned.Add(time.Minute)) {
+			t.Fatalf("expect jitter within a minute of %v, got %v", planned, next)
+		}
+		now = next
+	}
+}
+
+func TestCronTimerMissed(t *testing.T) {
+	last := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	loop := StartSimLoop(last.Add(time.Hour*72 + time.Minute))
+	defer loop.Cancel()
+	schedule, err := NewCron("0 0 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule.In(time.UTC).Since(last).SetMissed(MissedRunAll)
+	counts := make([]int, 2)
+	loop.Execute(ExecFunc(func() error {
+		for i := range counts {
+			index := i
+			NewTimer(TimeoutFunc(func(timer Timer) error {
+				counts[index]++
+				return nil
+			})).StartNow(schedule)
+		}
+		return nil
+	}))
+	loop.Advance(time.Hour * 24)
+	if counts[0] != 4 || counts[1] != 4 {
+		t.Fatalf("expect every timer to catch up on its own, got %v", counts)
+	}
+}
@@ -0,0 +1,242 @@
+package relay
+
+import (
+	gerrors "errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrNotProvided = gerrors.New("not provided")
+
+type Provided[T any] struct {
+	Name  string
+	Value T
+	Loop  Loop
+}
+
+type ProviderEvent[T any] struct {
+	Provided[T]
+	Available bool
+}
+
+type Reference[T any] struct {
+	name string
+}
+
+func Provide[T any](name string, value T) func() {
+	loop := IsInLoop()
+	entry := &providerentry{
+		key: providerkey{name: name, typeof: reflect.TypeOf((*T)(nil)).Elem()},
+		build: func() any {
+			return Provided[T]{Name: name, Value: value, Loop: loop}
+		},
+	}
+	registry.guard.Lock()
+	previous := registry.entries[entry.key]
+	registry.entries[entry.key] = entry
+	watchers := registry.watchers[entry.key]
+	registry.guard.Unlock()
+	for _, watcher := range watchers {
+		if previous != nil {
+			watcher.notify(previous, false)
+		}
+		watcher.notify(entry, true)
+	}
+	return func() {
+		registry.guard.Lock()
+		if registry.entries[entry.key] != entry {
+			registry.guard.Unlock()
+			return
+		}
+		delete(registry.entries, entry.key)
+		watchers := registry.watchers[entry.key]
+		registry.guard.Unlock()
+		for _, watcher := range watchers {
+			watcher.notify(entry, false)
+		}
+	}
+}
+
+func ProvideModule[T any](module Module, name string, value T) func() {
+	withdraw := Provide(name, value)
+	registry.guard.Lock()
+	registry.modules[module] = append(registry.modules[module], withdraw)
+	registry.guard.Unlock()
+	return withdraw
+}
+
+func withdrawModule(module Module) {
+	registry.guard.Lock()
+	withdraws := registry.modules[module]
+	delete(registry.modules, module)
+	registry.guard.Unlock()
+	for _, withdraw := range withdraws {
+		withdraw()
+	}
+}
+
+func Resolve[T any](name string) (Provided[T], bool) {
+	key := providerkey{name: name, typeof: reflect.TypeOf((*T)(nil)).Elem()}
+	registry.guard.Lock()
+	entry, ok := registry.entries[key]
+	registry.guard.Unlock()
+	if !ok {
+		return Provided[T]{Name: name}, false
+	}
+	return entry.provided().(Provided[T]), true
+}
+
+func Lookup[T any](name string) Reference[T] {
+	return Reference[T]{name: name}
+}
+
+func Watch[T any](name string, handler func(ProviderEvent[T])) func() {
+	key := providerkey{name: name, typeof: reflect.TypeOf((*T)(nil)).Elem()}
+	watcher := &providerwatcher{
+		loop: IsInLoop(),
+		handler: func(entry *providerentry, available bool) {
+			handler(ProviderEvent[T]{Provided: entry.provided().(Provided[T]), Available: available})
+		},
+	}
+	registry.guard.Lock()
+	list := registry.watchers[key]
+	registry.watchers[key] = append(list[:len(list):len(list)], watcher)
+	entry := registry.entries[key]
+	registry.guard.Unlock()
+	if entry != nil {
+		watcher.notify(entry, true)
+	}
+	return func() {
+		atomic.StoreInt32(&watcher.removed, 1)
+		registry.guard.Lock()
+		defer registry.guard.Unlock()
+		list := registry.watchers[key]
+		for i, element := range list {
+			if element == watcher {
+				list = append(list[:i:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(list) == 0 {
+			delete(registry.watchers, key)
+		} else {
+			registry.watchers[key] = list
+		}
+	}
+}
+
+func Invoke[T, R any](provided Provided[T], call func(T) (R, error)) (R, error) {
+	var result R
+	err := marshal(provided.Loop, func() error {
+		value, err := call(provided.Value)
+		if err == nil {
+			result = value
+		}
+		return err
+	})
+	return result, err
+}
+
+func (this Provided[T]) Call(call func(T) error) error {
+	return marshal(this.Loop, func() error {
+		return call(this.Value)
+	})
+}
+
+func (this Reference[T]) Name() string {
+	return this.name
+}
+
+func (this Reference[T]) Get() (Provided[T], bool) {
+	return Resolve[T](this.name)
+}
+
+func (this Reference[T]) Call(call func(T) error) error {
+	provided, ok := this.Get()
+	if !ok {
+		return ErrNotProvided
+	}
+	return provided.Call(call)
+}
+
+func (this Reference[T]) Watch(handler func(ProviderEvent[T])) func() {
+	return Watch(this.name, handler)
+}
+
+var registry = &providerregistry{
+	entries:  make(map[providerkey]*providerentry),
+	watchers: make(map[providerkey][]*providerwatcher),
+	modules:  make(map[Module][]func()),
+}
+
+type providerregistry struct {
+	guard    sync.Mutex
+	entries  map[providerkey]*providerentry
+	watchers map[providerkey][]*providerwatcher
+	modules  map[Module][]func()
+}
+
+type providerkey struct {
+	name   string
+	typeof reflect.Type
+}
+
+type providerentry struct {
+	key   providerkey
+	build func() any
+}
+
+type providerwatcher struct {
+	loop    Loop
+	handler func(entry *providerentry, available bool)
+	removed int32
+}
+
+func (this *providerentry) provided() any {
+	return this.build()
+}
+
+func (this *providerwatcher) notify(entry *providerentry, available bool) {
+	if atomic.LoadInt32(&this.removed) != 0 {
+		return
+	}
+	if this.loop == nil || IsInLoop() == this.loop {
+		this.handler(entry, available)
+		return
+	}
+	this.loop.Execute(ExecFunc(func() error {
+		if atomic.LoadInt32(&this.removed) == 0 {
+			this.handler(entry, available)
+		}
+		return nil
+	}))
+}
+
+func marshal(target Loop, call func() error) error {
+	if target == nil || IsInLoop() == target {
+		return call()
+	}
+	if currentloop() != nil {
+		_, err := Await(func() error {
+			return marshal(target, call)
+		})
+		return err
+	}
+	var result error
+	done := make(chan struct{})
+	err := target.Execute(ExecFunc(func() error {
+		defer close(done)
+		_, result = protect(call)
+		return nil
+	}))
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return result
+	case <-target.Done():
+		return target.Err()
+	}
+}
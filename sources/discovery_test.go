@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type testgreeter interface {
+	Greet(name string) string
+}
+
+type testgreeting struct{}
+
+func (this testgreeting) Greet(name string) string {
+	return "hello " + name
+}
+
+func TestProvideResolve(t *testing.T) {
+	provider := StartLoop()
+	consumer := StartLoop()
+	defer provider.Cancel()
+	defer consumer.Cancel()
+	events := make(chan bool, 4)
+	watched := make(chan struct{})
+	consumer.Execute(ExecFunc(func() error {
+		Lookup[testgreeter]("greeter").Watch(func(event ProviderEvent[testgreeter]) {
+			events <- event.Available
+		})
+		close(watched)
+		return nil
+	}))
+	<-watched
+	withdraw := make(chan func(), 1)
+	provider.Execute(ExecFunc(func() error {
+		withdraw <- Provide[testgreeter]("greeter", testgreeting{})
+		return nil
+	}))
+	unprovide := <-withdraw
+	results := make(chan error, 1)
+	consumer.Execute(ExecFunc(func() error {
+		provided, ok := Resolve[testgreeter]("greeter")
+		if !ok {
+			results <- errors.New("expect greeter to be provided")
+			return nil
+		}
+		result, err := Invoke(provided, func(greeter testgreeter) (string, error) {
+			if IsInLoop() != provider {
+				return "", errors.New("expect call on provider loop")
+			}
+			return greeter.Greet("relay"), nil
+		})
+		if err == nil && result != "hello relay" {
+			err = errors.Errorf("unexpected result %s", result)
+		}
+		if err == nil && IsInLoop() != consumer {
+			err = errors.New("expect to resume on consumer loop")
+		}
+		results <- err
+		return nil
+	}))
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+	unprovide()
+	if err := Lookup[testgreeter]("greeter").Call(func(testgreeter) error {
+		return nil
+	}); err != ErrNotProvided {
+		t.Fatalf("expect not provided, got %v", err)
+	}
+	for _, expect := range []bool{true, false} {
+		select {
+		case available := <-events:
+			if available != expect {
+				t.Fatalf("expect available %t, got %t", expect, available)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+type testmodule struct {
+	loop Loop
+}
+
+func (this *testmodule) Load(config Config) error {
+	this.loop = StartLoop()
+	done := make(chan struct{})
+	this.loop.Execute(ExecFunc(func() error {
+		ProvideModule[testgreeter](this, "module-greeter", testgreeting{})
+		close(done)
+		return nil
+	}))
+	<-done
+	return nil
+}
+
+func (this *testmodule) Unload() error {
+	this.loop.Cancel()
+	return nil
+}
+
+func TestProvideModule(t *testing.T) {
+	module := &testmodule{}
+	if err := module.Load(EmptyConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Resolve[testgreeter]("module-greeter"); !ok {
+		t.Fatal("expect module provider registered")
+	}
+	if err := unloadModules([]Module{module}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Resolve[testgreeter]("module-greeter"); ok {
+		t.Fatal("expect module provider withdrawn on unload")
+	}
+}
+
+func TestInvokeCancelledTarget(t *testing.T) {
+	provider := StartLoop()
+	consumer := StartLoop()
+	defer consumer.Cancel()
+	ready := make(chan struct{})
+	provider.Execute(ExecFunc(func() error {
+		close(ready)
+		<-provider.Done()
+		return nil
+	}))
+	<-ready
+	results := make(chan error, 1)
+	consumer.Execute(ExecFunc(func() error {
+		results <- Provided[testgreeter]{Value: testgreeting{}, Loop: provider}.Call(func(testgreeter) error {
+			return nil
+		})
+		return nil
+	}))
+	time.Sleep(time.Millisecond * 10)
+	provider.Cancel()
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Fatal("expect error from cancelled provider loop")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call not woken by provider cancellation")
+	}
+}
+
+func TestInvokePanickingProvider(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetPanicPolicy(PanicRecover)
+	provider := StartLoopWith(options)
+	defer provider.Cancel()
+	provided := Provided[testgreeter]{Value: testgreeting{}, Loop: provider}
+	results := make(chan error, 1)
+	go func() {
+		results <- provided.Call(func(testgreeter) error {
+			panic("broken")
+		})
+	}()
+	select {
+	case err := <-results:
+		if err == nil || err.Error() != "broken" {
+			t.Fatalf("expect panic as error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call hangs after the provider panicked")
+	}
+}
@@ -1,16 +1,20 @@
 package relay
 
 import (
-	"container/list"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
 )
 
 type Event struct {
-	listeners *list.List
+	listeners atomic.Value
 }
 
 type EventArg[T any] struct {
-	listeners *list.List
+	listeners atomic.Value
 }
 
 type EventHandle interface {
@@ -21,79 +25,272 @@ type EventArgHandle[T any] interface {
 	Handle(T) error
 }
 
+type ListenOptions struct {
+	priority int
+	once     bool
+	deliver  bool
+}
+
+func DefaultListenOptions() ListenOptions {
+	return ListenOptions{}
+}
+
+func (this ListenOptions) SetPriority(priority int) ListenOptions {
+	this.priority = priority
+	return this
+}
+
+func (this ListenOptions) SetOnce(once bool) ListenOptions {
+	this.once = once
+	return this
+}
+
+func (this ListenOptions) SetDeliver(deliver bool) ListenOptions {
+	this.deliver = deliver
+	return this
+}
+
 func (this *Event) Listen(listener func() error) func() {
-	if this.listeners == nil {
-		this.listeners = list.New()
+	return this.ListenWith(listener, DefaultListenOptions())
+}
+
+func (this *Event) Once(listener func() error) func() {
+	return this.ListenWith(listener, DefaultListenOptions().SetOnce(true))
+}
+
+func (this *Event) Subscribe(listener func() error) func() {
+	return this.ListenWith(listener, DefaultListenOptions().SetDeliver(true))
+}
+
+func (this *Event) ListenWith(listener func() error, options ListenOptions) func() {
+	return ensurelisteners[func() error](&this.listeners).add(listener, options)
+}
+
+func (this *Event) Len() int {
+	return loadlisteners[func() error](&this.listeners).len()
+}
+
+func (this *Event) Emit() error {
+	return loadlisteners[func() error](&this.listeners).emit(func(listener func() error) error {
+		return listener()
+	})
+}
+
+func (this *EventArg[T]) Listen(listener func(T) error) func() {
+	return this.ListenWith(listener, DefaultListenOptions())
+}
+
+func (this *EventArg[T]) Once(listener func(T) error) func() {
+	return this.ListenWith(listener, DefaultListenOptions().SetOnce(true))
+}
+
+func (this *EventArg[T]) Subscribe(listener func(T) error) func() {
+	return this.ListenWith(listener, DefaultListenOptions().SetDeliver(true))
+}
+
+func (this *EventArg[T]) ListenWith(listener func(T) error, options ListenOptions) func() {
+	return ensurelisteners[func(T) error](&this.listeners).add(listener, options)
+}
+
+func (this *EventArg[T]) Len() int {
+	return loadlisteners[func(T) error](&this.listeners).len()
+}
+
+func (this *EventArg[T]) Emit(value T) error {
+	return loadlisteners[func(T) error](&this.listeners).emit(func(listener func(T) error) error {
+		return listener(value)
+	})
+}
+
+func loadlisteners[F any](value *atomic.Value) *eventlisteners[F] {
+	result, _ := value.Load().(*eventlisteners[F])
+	return result
+}
+
+func ensurelisteners[F any](value *atomic.Value) *eventlisteners[F] {
+	if result := loadlisteners[F](value); result != nil {
+		return result
 	}
-	element := this.listeners.PushBack(listener)
+	value.CompareAndSwap(nil, &eventlisteners[F]{})
+	return loadlisteners[F](value)
+}
+
+type eventlisteners[F any] struct {
+	guard sync.Mutex
+	list  []*eventlistener[F]
+	seq   uint64
+}
+
+type eventlistener[F any] struct {
+	handler  F
+	priority int
+	once     bool
+	loop     Loop
+	seq      uint64
+	removed  int32
+}
+
+func (this *eventlisteners[F]) add(handler F, options ListenOptions) func() {
+	listener := &eventlistener[F]{handler: handler, priority: options.priority, once: options.once}
+	if options.deliver {
+		listener.loop = InLoop()
+	}
+	this.guard.Lock()
+	this.seq++
+	listener.seq = this.seq
+	list := make([]*eventlistener[F], len(this.list), len(this.list)+1)
+	copy(list, this.list)
+	index := sort.Search(len(list), func(i int) bool {
+		return list[i].priority < listener.priority
+	})
+	list = append(list, nil)
+	copy(list[index+1:], list[index:])
+	list[index] = listener
+	this.list = list
+	this.guard.Unlock()
 	return func() {
-		this.listeners.Remove(element)
+		this.remove(listener)
 	}
 }
 
-func (this Event) Emit() error {
-	if this.listeners == nil {
-		return nil
+func (this *eventlisteners[F]) remove(listener *eventlistener[F]) bool {
+	if !atomic.CompareAndSwapInt32(&listener.removed, 0, 1) {
+		return false
 	}
-	var errors []error
-	element := this.listeners.Front()
-	for element != nil {
-		listener := element.Value.(func() error)
-		err := listener()
-		if err != nil {
-			errors = append(errors, err)
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	for i, element := range this.list {
+		if element == listener {
+			list := make([]*eventlistener[F], 0, len(this.list)-1)
+			list = append(list, this.list[:i]...)
+			this.list = append(list, this.list[i+1:]...)
+			break
 		}
-		element = element.Next()
 	}
-	if len(errors) == 0 {
-		return nil
-	}
-	return &eventerror{list: errors}
+	return true
 }
 
-func (this *EventArg[T]) Listen(listener func(T) error) func() {
-	if this.listeners == nil {
-		this.listeners = list.New()
-	}
-	element := this.listeners.PushBack(listener)
-	return func() {
-		this.listeners.Remove(element)
+func (this *eventlisteners[F]) len() int {
+	if this == nil {
+		return 0
 	}
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	return len(this.list)
 }
 
-func (this EventArg[T]) Emit(value T) error {
-	if this.listeners == nil {
+func (this *eventlisteners[F]) emit(call func(F) error) error {
+	if this == nil {
 		return nil
 	}
-	var errors []error
-	element := this.listeners.Front()
-	for element != nil {
-		listener := element.Value.(func(T) error)
-		err := listener(value)
+	this.guard.Lock()
+	list := this.list
+	this.guard.Unlock()
+	var failed []error
+	var delivered []*eventdelivery
+	for _, listener := range list {
+		if listener.once {
+			if !this.remove(listener) {
+				continue
+			}
+		} else if atomic.LoadInt32(&listener.removed) != 0 {
+			continue
+		}
+		if listener.loop == nil {
+			if err := call(listener.handler); err != nil {
+				failed = append(failed, err)
+			}
+			continue
+		}
+		listener := listener
+		delivery := &eventdelivery{loop: listener.loop, result: make(chan error, 1)}
+		err := listener.loop.Execute(ExecFunc(func() error {
+			if !listener.once && atomic.LoadInt32(&listener.removed) != 0 {
+				delivery.result <- nil
+				return nil
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					if err, ok := r.(error); ok {
+						delivery.result <- err
+					} else {
+						delivery.result <- errors.Errorf("%v", r)
+					}
+					panic(r)
+				}
+			}()
+			delivery.result <- call(listener.handler)
+			return nil
+		}))
 		if err != nil {
-			errors = append(errors, err)
+			failed = append(failed, err)
+			continue
 		}
-		element = element.Next()
+		delivered = append(delivered, delivery)
 	}
+	for _, delivery := range delivered {
+		if err := delivery.wait(); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return joinerrors(failed)
+}
+
+type eventdelivery struct {
+	loop   Loop
+	result chan error
+}
+
+func (this *eventdelivery) wait() error {
+	var result error
+	wait := func() {
+		select {
+		case result = <-this.result:
+		case <-this.loop.Done():
+			result = this.loop.Err()
+		}
+	}
+	if current := currentloop(); current != nil {
+		current.park(wait)
+	} else {
+		wait()
+	}
+	return result
+}
+
+type joinerror struct {
+	errors []error
+}
+
+func joinerrors(errors []error) error {
 	if len(errors) == 0 {
 		return nil
 	}
-	return &eventerror{list: errors}
+	return &joinerror{errors: errors}
 }
 
-type eventerror struct {
-	list   []error
-	errmsg *string
+func (this *joinerror) Error() string {
+	list := make([]string, len(this.errors))
+	for i, err := range this.errors {
+		list[i] = err.Error()
+	}
+	return strings.Join(list, "\n")
+}
+
+func (this *joinerror) Is(target error) bool {
+	for _, err := range this.errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
 }
 
-func (this *eventerror) Error() string {
-	if this.errmsg == nil {
-		list := make([]string, len(this.list))
-		for i := 0; i < len(this.list); i++ {
-			list[i] = this.list[i].Error()
+func (this *joinerror) As(target any) bool {
+	for _, err := range this.errors {
+		if errors.As(err, target) {
+			return true
 		}
-		result := strings.Join(list, "\n")
-		this.errmsg = &result
 	}
-	return *this.errmsg
+	return false
 }
@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestEventPriorityAndOnce(t *testing.T) {
+	var event EventArg[int]
+	var calls []string
+	event.ListenWith(func(value int) error {
+		calls = append(calls, "low")
+		return nil
+	}, DefaultListenOptions().SetPriority(-1))
+	var unlisten func()
+	unlisten = event.Listen(func(value int) error {
+		calls = append(calls, "normal")
+		unlisten()
+		return nil
+	})
+	event.Listen(func(value int) error {
+		calls = append(calls, "later")
+		return nil
+	})
+	event.ListenWith(func(value int) error {
+		calls = append(calls, "high")
+		return nil
+	}, DefaultListenOptions().SetPriority(10).SetOnce(true))
+	if err := event.Emit(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := event.Emit(2); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"high", "normal", "later", "low", "later", "low"}
+	if !reflect.DeepEqual(calls, expect) {
+		t.Fatalf("expect %v, got %v", expect, calls)
+	}
+	if event.Len() != 2 {
+		t.Fatalf("expect 2 listeners, got %d", event.Len())
+	}
+}
+
+func TestEventErrors(t *testing.T) {
+	var event Event
+	first := errors.New("first")
+	second := errors.New("second")
+	event.Listen(func() error {
+		return first
+	})
+	event.Listen(func() error {
+		return second
+	})
+	err := event.Emit()
+	if !errors.Is(err, first) || !errors.Is(err, second) {
+		t.Fatalf("expect joined errors, got %v", err)
+	}
+}
+
+func TestEventDeliverOnLoop(t *testing.T) {
+	loop := StartLoop()
+	defer loop.Cancel()
+	var event EventArg[string]
+	ready := make(chan struct{})
+	results := make(chan Loop, 1)
+	loop.Execute(ExecFunc(func() error {
+		event.Subscribe(func(value string) error {
+			results <- IsInLoop()
+			return nil
+		})
+		close(ready)
+		return nil
+	}))
+	<-ready
+	if err := event.Emit("hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-results:
+		if result != loop {
+			t.Fatalf("expect delivery on %v, got %v", loop, result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestEventCopyAndDeliverErrors(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetPanicPolicy(PanicRecover)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	var event EventArg[string]
+	failed := errors.New("failed")
+	ready := make(chan struct{})
+	loop.Execute(ExecFunc(func() error {
+		event.Subscribe(func(value string) error {
+			return failed
+		})
+		event.Subscribe(func(value string) error {
+			panic("broken")
+		})
+		close(ready)
+		return nil
+	}))
+	<-ready
+	copied := event
+	err := copied.Emit("hello")
+	if !errors.Is(err, failed) || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expect delivered handler errors, got %v", err)
+	}
+	if copied.Len() != 2 {
+		t.Fatalf("expect copy to share listeners, got %d", copied.Len())
+	}
+}
+
+func TestEventConcurrentListen(t *testing.T) {
+	var event Event
+	var arg EventArg[int]
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			event.Listen(func() error {
+				return nil
+			})
+			arg.Listen(func(int) error {
+				return nil
+			})
+			event.Emit()
+		}()
+	}
+	wait.Wait()
+	if event.Len() != 8 || arg.Len() != 8 {
+		t.Fatalf("expect 8 listeners, got %d and %d", event.Len(), arg.Len())
+	}
+}
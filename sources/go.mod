@@ -5,12 +5,15 @@ go 1.18
 require (
 	github.com/BurntSushi/toml v1.0.0
 	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.16.7
 	github.com/mattn/go-colorable v0.1.12
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/pkg/errors v0.9.1
 	github.com/robfig/cron/v3 v3.0.0
+	golang.org/x/crypto v0.17.0
 )
 
 require (
 	github.com/mattn/go-isatty v0.0.14 // indirect
-	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 )
@@ -0,0 +1,356 @@
+package relay
+
+import (
+	gerrors "errors"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBreakerOpen = gerrors.New("circuit breaker open")
+var ErrBulkheadFull = gerrors.New("bulkhead full")
+
+type Guard interface {
+	Execute(action func() error) error
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+type BreakerChange struct {
+	Name string
+	From BreakerState
+	To   BreakerState
+}
+
+type BreakerOptions struct {
+	name      string
+	failures  int
+	timeout   time.Duration
+	probes    int
+	successes int
+}
+
+type CircuitBreaker struct {
+	options     BreakerOptions
+	guard       sync.Mutex
+	state       BreakerState
+	consecutive int
+	probing     int
+	succeeded   int
+	generation  uint64
+	opened      time.Time
+	changed     EventArg[BreakerChange]
+}
+
+type Bulkhead struct {
+	guard   sync.Mutex
+	max     int
+	queue   int
+	running int
+	waiters []func() bool
+}
+
+func DefaultBreakerOptions() BreakerOptions {
+	return BreakerOptions{failures: 5, timeout: time.Second * 10, probes: 1, successes: 1}
+}
+
+func (this BreakerOptions) SetName(name string) BreakerOptions {
+	this.name = name
+	return this
+}
+
+func (this BreakerOptions) SetFailures(failures int) BreakerOptions {
+	if failures > 0 {
+		this.failures = failures
+	}
+	return this
+}
+
+func (this BreakerOptions) SetOpenTimeout(timeout time.Duration) BreakerOptions {
+	if timeout > 0 {
+		this.timeout = timeout
+	}
+	return this
+}
+
+func (this BreakerOptions) SetHalfOpen(probes int, successes int) BreakerOptions {
+	if probes > 0 {
+		this.probes = probes
+	}
+	if successes > 0 {
+		this.successes = successes
+	}
+	return this
+}
+
+func (this BreakerState) String() string {
+	switch this {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+func NewCircuitBreaker(options BreakerOptions) *CircuitBreaker {
+	return &CircuitBreaker{options: options}
+}
+
+func (this *CircuitBreaker) State() BreakerState {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	this.expire(Now())
+	return this.state
+}
+
+func (this *CircuitBreaker) OnChange(listener func(BreakerChange) error) func() {
+	return this.changed.Listen(listener)
+}
+
+func (this *CircuitBreaker) Allow() (func(error), error) {
+	this.guard.Lock()
+	change := this.expire(Now())
+	var err error
+	switch this.state {
+	case BreakerOpen:
+		err = ErrBreakerOpen
+	case BreakerHalfOpen:
+		if this.probing >= this.options.probes {
+			err = ErrBreakerOpen
+		} else {
+			this.probing++
+		}
+	}
+	generation := this.generation
+	this.guard.Unlock()
+	this.emit(change)
+	if err != nil {
+		return nil, err
+	}
+	return func(err error) {
+		this.done(generation, err)
+	}, nil
+}
+
+func (this *CircuitBreaker) Execute(action func() error) error {
+	done, err := this.Allow()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if err, ok := r.(error); ok {
+				done(err)
+			} else {
+				done(errors.Errorf("%v", r))
+			}
+			panic(r)
+		}
+		done(err)
+	}()
+	err = action()
+	return err
+}
+
+func (this *CircuitBreaker) done(generation uint64, err error) {
+	this.guard.Lock()
+	var change *BreakerChange
+	if generation != this.generation {
+		this.guard.Unlock()
+		return
+	}
+	now := Now()
+	switch this.state {
+	case BreakerHalfOpen:
+		this.probing--
+		if err != nil {
+			change = this.transition(BreakerOpen, now)
+		} else {
+			this.succeeded++
+			if this.succeeded >= this.options.successes {
+				change = this.transition(BreakerClosed, now)
+			}
+		}
+	case BreakerClosed:
+		if err != nil {
+			this.consecutive++
+			if this.consecutive >= this.options.failures {
+				change = this.transition(BreakerOpen, now)
+			}
+		} else {
+			this.consecutive = 0
+		}
+	}
+	this.guard.Unlock()
+	this.emit(change)
+}
+
+func (this *CircuitBreaker) expire(now time.Time) *BreakerChange {
+	if this.state == BreakerOpen && !now.Before(this.opened.Add(this.options.timeout)) {
+		return this.transition(BreakerHalfOpen, now)
+	}
+	return nil
+}
+
+func (this *CircuitBreaker) transition(state BreakerState, now time.Time) *BreakerChange {
+	change := &BreakerChange{Name: this.options.name, From: this.state, To: state}
+	this.state = state
+	this.generation++
+	this.consecutive = 0
+	this.probing = 0
+	this.succeeded = 0
+	if state == BreakerOpen {
+		this.opened = now
+	}
+	return change
+}
+
+func (this *CircuitBreaker) emit(change *BreakerChange) {
+	if change == nil {
+		return
+	}
+	if err := this.changed.Emit(*change); err != nil {
+		Logger().Error().Err(err).Str("breaker", change.Name).Msg("breaker listener failed")
+	}
+}
+
+func NewBulkhead(max int, queue int) *Bulkhead {
+	if max <= 0 {
+		max = 1
+	}
+	return &Bulkhead{max: max, queue: queue}
+}
+
+func (this *Bulkhead) Running() int {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	return this.running
+}
+
+func (this *Bulkhead) Waiting() int {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	return len(this.waiters)
+}
+
+func (this *Bulkhead) Acquire() (func(), error) {
+	this.guard.Lock()
+	if this.running < this.max {
+		this.running++
+		this.guard.Unlock()
+		return this.release, nil
+	}
+	if len(this.waiters) >= this.queue {
+		this.guard.Unlock()
+		return nil, ErrBulkheadFull
+	}
+	current := currentloop()
+	if current == nil {
+		signal := make(chan struct{})
+		this.waiters = append(this.waiters, func() bool {
+			close(signal)
+			return true
+		})
+		this.guard.Unlock()
+		<-signal
+		return this.release, nil
+	}
+	var granted, cancelled bool
+	current.pause(func(wake func()) {
+		this.waiters = append(this.waiters, func() bool {
+			if cancelled {
+				return false
+			}
+			granted = true
+			wake()
+			return true
+		})
+		this.guard.Unlock()
+	})
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if !granted {
+		cancelled = true
+		return nil, current.Err()
+	}
+	return this.release, nil
+}
+
+func (this *Bulkhead) Execute(action func() error) error {
+	release, err := this.Acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return action()
+}
+
+func (this *Bulkhead) release() {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	for len(this.waiters) != 0 {
+		wake := this.waiters[0]
+		this.waiters[0] = nil
+		this.waiters = this.waiters[1:]
+		if wake() {
+			return
+		}
+	}
+	this.running--
+}
+
+func Guarded(guards []Guard, action func() error) error {
+	if len(guards) == 0 {
+		return action()
+	}
+	return guards[0].Execute(func() error {
+		return Guarded(guards[1:], action)
+	})
+}
+
+func GuardFunc(implement func() error, guards ...Guard) func() error {
+	return func() error {
+		return Guarded(guards, implement)
+	}
+}
+
+func GuardFuncArg[Arg any](implement func(Arg) error, guards ...Guard) func(Arg) error {
+	return func(arg Arg) error {
+		return Guarded(guards, func() error {
+			return implement(arg)
+		})
+	}
+}
+
+func GuardFuncResult[Result any](implement func() (Result, error), guards ...Guard) func() (Result, error) {
+	return func() (Result, error) {
+		var result Result
+		err := Guarded(guards, func() error {
+			var err error
+			result, err = implement()
+			return err
+		})
+		return result, err
+	}
+}
+
+func GuardFuncArgResult[Arg, Result any](implement func(Arg) (Result, error), guards ...Guard) func(Arg) (Result, error) {
+	return func(arg Arg) (Result, error) {
+		var result Result
+		err := Guarded(guards, func() error {
+			var err error
+			result, err = implement(arg)
+			return err
+		})
+		return result, err
+	}
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var changes []string
+	var breaker *CircuitBreaker
+	var results []error
+	failing := errors.New("failing")
+	call := func(err error) {
+		loop.Execute(ExecFunc(func() error {
+			results = append(results, breaker.Execute(func() error {
+				return err
+			}))
+			return nil
+		}))
+		loop.Flush()
+	}
+	loop.Execute(ExecFunc(func() error {
+		breaker = NewCircuitBreaker(DefaultBreakerOptions().SetName("db").SetFailures(2).SetOpenTimeout(time.Second * 5))
+		breaker.OnChange(func(change BreakerChange) error {
+			changes = append(changes, change.From.String()+">"+change.To.String())
+			return nil
+		})
+		return nil
+	}))
+	call(failing)
+	call(failing)
+	call(nil)
+	loop.Advance(time.Second * 5)
+	call(failing)
+	call(nil)
+	loop.Advance(time.Second * 5)
+	call(nil)
+	call(nil)
+	expect := []error{failing, failing, ErrBreakerOpen, failing, ErrBreakerOpen, nil, nil}
+	if !reflect.DeepEqual(results, expect) {
+		t.Fatalf("expect %v, got %v", expect, results)
+	}
+	expectChanges := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if !reflect.DeepEqual(changes, expectChanges) {
+		t.Fatalf("expect %v, got %v", expectChanges, changes)
+	}
+}
+
+func TestCircuitBreakerPanic(t *testing.T) {
+	loop := StartSimLoop(time.Unix(0, 0))
+	defer loop.Cancel()
+	var breaker *CircuitBreaker
+	var results []error
+	call := func(action func() error) {
+		loop.Execute(ExecFunc(func() error {
+			defer func() {
+				if r := recover(); r != nil {
+					results = append(results, errors.Errorf("%v", r))
+				}
+			}()
+			results = append(results, breaker.Execute(action))
+			return nil
+		}))
+		loop.Flush()
+	}
+	loop.Execute(ExecFunc(func() error {
+		breaker = NewCircuitBreaker(DefaultBreakerOptions().SetFailures(1).SetOpenTimeout(time.Second))
+		return nil
+	}))
+	call(func() error {
+		return errors.New("failing")
+	})
+	loop.Advance(time.Second)
+	call(func() error {
+		panic("broken")
+	})
+	if len(results) != 2 || results[1].Error() != "broken" {
+		t.Fatalf("expect probe panic to propagate, got %v", results)
+	}
+	var state BreakerState
+	loop.Execute(ExecFunc(func() error {
+		state = breaker.State()
+		return nil
+	}))
+	loop.Flush()
+	if state != BreakerOpen {
+		t.Fatalf("expect panicking probe to reopen the breaker, got %v", state)
+	}
+	loop.Advance(time.Second)
+	call(func() error {
+		return nil
+	})
+	if results[2] != nil {
+		t.Fatalf("expect a new probe after the panic, got %v", results[2])
+	}
+}
+
+func TestBulkhead(t *testing.T) {
+	loop := StartSimLoop(time.Unix(0, 0))
+	defer loop.Cancel()
+	bulkhead := NewBulkhead(1, 1)
+	var order []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		loop.Execute(ExecFunc(func() error {
+			err := bulkhead.Execute(func() error {
+				order = append(order, name)
+				return Sleep(time.Second)
+			})
+			if err != nil {
+				order = append(order, name+":"+err.Error())
+			}
+			return nil
+		}))
+	}
+	loop.Advance(time.Second * 3)
+	expect := []string{"a", "c:bulkhead full", "b"}
+	if !reflect.DeepEqual(order, expect) {
+		t.Fatalf("expect %v, got %v", expect, order)
+	}
+	if bulkhead.Running() != 0 || bulkhead.Waiting() != 0 {
+		t.Fatalf("expect idle bulkhead, got %d running %d waiting", bulkhead.Running(), bulkhead.Waiting())
+	}
+}
+
+func TestBulkheadCancel(t *testing.T) {
+	bulkhead := NewBulkhead(1, 1)
+	holder := StartLoop()
+	defer holder.Cancel()
+	release := make(chan func(), 1)
+	holder.Execute(ExecFunc(func() error {
+		done, err := bulkhead.Acquire()
+		if err != nil {
+			return err
+		}
+		release <- done
+		return nil
+	}))
+	done := <-release
+	waiter := StartLoop()
+	result := make(chan error, 1)
+	waiter.Execute(ExecFunc(func() error {
+		_, err := bulkhead.Acquire()
+		result <- err
+		return nil
+	}))
+	time.Sleep(time.Millisecond * 10)
+	waiter.Cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("expect cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire not woken by cancellation")
+	}
+	done()
+	if bulkhead.Running() != 0 {
+		t.Fatalf("expect slot returned, got %d running", bulkhead.Running())
+	}
+}
@@ -1,3 +1,5 @@
+//go:build ((386 || amd64 || amd64p32 || arm || arm64) && !purego) || wasm
+
 package g
 
 import (
@@ -6,6 +8,21 @@ import (
 
 func getg() unsafe.Pointer
 
-func Get() unsafe.Pointer {
-	return getg()
+func Get() uintptr {
+	return uintptr(getg())
+}
+
+func Bind() uintptr {
+	return Get()
+}
+
+func Enter() uintptr {
+	return 0
+}
+
+func Leave() {
+}
+
+func Thread() uintptr {
+	return 0
 }
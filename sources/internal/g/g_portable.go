@@ -0,0 +1,46 @@
+//go:build !(386 || amd64 || amd64p32 || arm || arm64 || wasm) || (purego && !wasm)
+
+package g
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
+	"unsafe"
+)
+
+var bound uint64
+
+//go:linkname getProfLabel runtime/pprof.runtime_getProfLabel
+func getProfLabel() unsafe.Pointer
+
+//go:linkname getm runtime.getm
+func getm() uintptr
+
+// Get returns the label set installed by Bind. Goroutines started from a bound
+// goroutine inherit it, so Enter pins the bound goroutine to its thread and
+// Thread tells them apart.
+func Get() uintptr {
+	return uintptr(getProfLabel())
+}
+
+func Bind() uintptr {
+	id := atomic.AddUint64(&bound, 1)
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("relay.coroutine", strconv.FormatUint(id, 10))))
+	return Get()
+}
+
+func Enter() uintptr {
+	runtime.LockOSThread()
+	return getm()
+}
+
+func Leave() {
+	runtime.UnlockOSThread()
+}
+
+func Thread() uintptr {
+	return getm()
+}
@@ -0,0 +1,55 @@
+package g
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGetStable(t *testing.T) {
+	first := Bind()
+	if first == 0 {
+		t.Fatal("zero goroutine identity")
+	}
+	for i := 0; i < 10; i++ {
+		if Get() != first {
+			t.Fatal("goroutine identity changed")
+		}
+	}
+}
+
+func TestGetDistinct(t *testing.T) {
+	const count = 32
+	var wait, ready sync.WaitGroup
+	var guard sync.Mutex
+	release := make(chan struct{})
+	seen := make(map[uintptr]struct{})
+	wait.Add(count)
+	ready.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			defer wait.Done()
+			pointer := Bind()
+			guard.Lock()
+			seen[pointer] = struct{}{}
+			guard.Unlock()
+			ready.Done()
+			<-release
+			if Get() != pointer {
+				t.Error("goroutine identity changed")
+			}
+		}()
+	}
+	ready.Wait()
+	close(release)
+	wait.Wait()
+	if len(seen) != count {
+		t.Fatalf("expect %d identities, got %d", count, len(seen))
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	Bind()
+	for i := 0; i < b.N; i++ {
+		Get()
+	}
+}
@@ -1 +1,3 @@
+//go:build !purego
+
 #include "getg_amd64.s"
@@ -0,0 +1,188 @@
+package job
+
+import (
+	"relay"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Semantics int
+
+const (
+	AtLeastOnce Semantics = iota
+	AtMostOnce
+)
+
+const defaultHistory = 16
+const defaultRetry = time.Second
+const defaultMaxRetry = time.Hour
+
+type Scheduler struct {
+	store    Store
+	history  int
+	retry    time.Duration
+	maxRetry time.Duration
+	jobs     map[string]*job
+}
+
+type job struct {
+	name      string
+	semantics Semantics
+	cron      *relay.CronSchedule
+	timer     relay.NamedTimer
+	action    func() error
+	record    Record
+	failures  int
+}
+
+type schedule struct {
+	cron  *relay.CronSchedule
+	since time.Time
+	retry time.Time
+	due   time.Time
+}
+
+func NewScheduler(store Store) *Scheduler {
+	return &Scheduler{store: store, history: defaultHistory, retry: defaultRetry, maxRetry: defaultMaxRetry, jobs: make(map[string]*job)}
+}
+
+func (this *Scheduler) SetHistory(size int) *Scheduler {
+	if size >= 0 {
+		this.history = size
+	}
+	return this
+}
+
+func (this *Scheduler) SetRetry(min, max time.Duration) *Scheduler {
+	if min > 0 && max >= min {
+		this.retry = min
+		this.maxRetry = max
+	}
+	return this
+}
+
+func (this *Scheduler) Add(name string, cron *relay.CronSchedule, semantics Semantics, action func() error) error {
+	relay.InLoop()
+	if _, ok := this.jobs[name]; ok {
+		return errors.Errorf("job %s already exists", name)
+	}
+	results, err := relay.Await(this.store.Load, name)
+	if err != nil {
+		return err
+	}
+	record := results[0].(Record)
+	record.Name = name
+	result := &job{name: name, semantics: semantics, cron: cron, action: action, record: record}
+	result.timer = relay.NewNamedTimer("job:"+name, relay.TimeoutFunc(func(timer relay.Timer) error {
+		return this.run(result)
+	}))
+	this.jobs[name] = result
+	if semantics == AtLeastOnce && !record.Retry.IsZero() {
+		now := relay.Now()
+		result.timer.Start(now, &schedule{cron: cron, since: record.LastRun, retry: record.Retry, due: now})
+	} else {
+		result.timer.StartNow(&schedule{cron: cron, since: record.LastRun})
+	}
+	result.record.NextRun, _ = result.timer.Next()
+	return this.save(result)
+}
+
+func (this *Scheduler) Remove(name string) error {
+	relay.InLoop()
+	if job, ok := this.jobs[name]; ok {
+		job.timer.Close()
+		delete(this.jobs, name)
+	}
+	_, err := relay.Await(this.store.Delete, name)
+	return err
+}
+
+func (this *Scheduler) Jobs() []Record {
+	relay.InLoop()
+	result := make([]Record, 0, len(this.jobs))
+	for _, job := range this.jobs {
+		result = append(result, copyRecord(job.record))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (this *Scheduler) History(name string) []Run {
+	relay.InLoop()
+	if job, ok := this.jobs[name]; ok {
+		return append([]Run(nil), job.record.History...)
+	}
+	return nil
+}
+
+func (this *Scheduler) run(job *job) error {
+	run := Run{Planned: job.timer.Planned(), Start: relay.Now()}
+	if job.semantics == AtMostOnce {
+		job.record.LastRun = run.Planned
+		err := this.save(job)
+		if err != nil {
+			return err
+		}
+	}
+	err := job.action()
+	run.End = relay.Now()
+	if err != nil {
+		run.Error = err.Error()
+		if job.semantics == AtLeastOnce {
+			job.record.Retry = run.Planned
+			job.timer.Start(run.End, &schedule{cron: job.cron, since: job.record.LastRun, retry: run.Planned, due: run.End.Add(this.backoff(job.failures))})
+			job.failures++
+		}
+	} else if job.semantics == AtLeastOnce {
+		job.record.LastRun = run.Planned
+		job.record.Retry = time.Time{}
+		job.failures = 0
+	}
+	job.record.NextRun, _ = job.timer.Next()
+	if this.history > 0 {
+		job.record.History = append(job.record.History, run)
+		if len(job.record.History) > this.history {
+			job.record.History = append([]Run(nil), job.record.History[len(job.record.History)-this.history:]...)
+		}
+	}
+	saveErr := this.save(job)
+	if err != nil {
+		return err
+	}
+	return saveErr
+}
+
+func (this *Scheduler) save(job *job) error {
+	_, err := relay.Await(this.store.Save, copyRecord(job.record))
+	return err
+}
+
+func (this *Scheduler) backoff(failures int) time.Duration {
+	delay := this.retry
+	for i := 0; i < failures && delay < this.maxRetry; i++ {
+		delay *= 2
+	}
+	if delay > this.maxRetry {
+		delay = this.maxRetry
+	}
+	return delay
+}
+
+func (this *schedule) Next(now time.Time) time.Time {
+	_, next := this.Plan(time.Time{}, now)
+	return next
+}
+
+func (this *schedule) Plan(last, now time.Time) (time.Time, time.Time) {
+	if last.IsZero() {
+		if !this.retry.IsZero() {
+			return this.retry, this.due
+		}
+		last = this.since
+	}
+	return this.cron.Plan(last, now)
+}
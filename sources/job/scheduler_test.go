@@ -0,0 +1,179 @@
+package job
+
+import (
+	"path/filepath"
+	"relay"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func startWeekly(t *testing.T, store Store, now time.Time, runs *[]time.Time) relay.SimLoop {
+	loop := relay.StartSimLoop(now)
+	errs := make(chan error, 1)
+	loop.Execute(relay.ExecFunc(func() error {
+		cron, err := relay.NewCron("0 12 * * MON")
+		if err == nil {
+			cron.In(time.UTC).SetMissed(relay.MissedRunOnce)
+			err = NewScheduler(store).Add("weekly", cron, AtMostOnce, func() error {
+				*runs = append(*runs, relay.Now())
+				return nil
+			})
+		}
+		errs <- err
+		return nil
+	}))
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return loop
+}
+
+func TestSchedulerSurvivesRestart(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var runs []time.Time
+	loop := startWeekly(t, store, start, &runs)
+	loop.Advance(time.Hour * 24 * 14)
+	loop.Cancel()
+	if len(runs) != 2 {
+		t.Fatalf("expect 2 runs, got %v", runs)
+	}
+
+	store, err = NewFileStore(store.(*fileStore).path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop = startWeekly(t, store, start.Add(time.Hour*24*14), &runs)
+	loop.Advance(time.Hour)
+	loop.Cancel()
+	if len(runs) != 2 {
+		t.Fatalf("expect no rerun after restart, got %v", runs)
+	}
+
+	loop = startWeekly(t, store, start.Add(time.Hour*24*30), &runs)
+	loop.Advance(time.Hour)
+	loop.Cancel()
+	if len(runs) != 3 {
+		t.Fatalf("expect one catch-up run, got %v", runs)
+	}
+	record, ok, err := store.Load("weekly")
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if len(record.History) != 3 || !record.NextRun.Equal(time.Date(2022, 1, 31, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
+
+func startHourly(t *testing.T, store Store, now time.Time, failures *int) relay.SimLoop {
+	loop := relay.StartSimLoop(now)
+	errs := make(chan error, 1)
+	loop.Execute(relay.ExecFunc(func() error {
+		cron, err := relay.NewCron("0 * * * *")
+		if err == nil {
+			cron.In(time.UTC)
+			err = NewScheduler(store).Add("hourly", cron, AtLeastOnce, func() error {
+				if *failures > 0 {
+					*failures--
+					return errors.New("failed")
+				}
+				return nil
+			})
+		}
+		errs <- err
+		return nil
+	}))
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return loop
+}
+
+func TestSchedulerRetriesFailedRun(t *testing.T) {
+	store := NewMemoryStore()
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	planned := start.Add(time.Hour)
+	failures := 2
+	loop := startHourly(t, store, start, &failures)
+	loop.Advance(time.Hour + time.Second*3)
+	loop.Cancel()
+	record, _, err := store.Load("hourly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.History) != 3 || !record.LastRun.Equal(planned) || !record.Retry.IsZero() {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	for i, run := range record.History {
+		if !run.Planned.Equal(planned) || (run.Error == "") != (i == 2) {
+			t.Fatalf("unexpected run %d %+v", i, run)
+		}
+	}
+	if !record.History[2].Start.Equal(planned.Add(time.Second * 3)) {
+		t.Fatalf("expect backoff to double, retried at %v", record.History[2].Start)
+	}
+}
+
+func TestSchedulerCatchesUpFailedRunAfterRestart(t *testing.T) {
+	store := NewMemoryStore()
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	planned := start.Add(time.Hour)
+	failures := 1
+	loop := startHourly(t, store, start, &failures)
+	loop.Advance(time.Hour)
+	loop.Cancel()
+	record, _, err := store.Load("hourly")
+	if err != nil || !record.Retry.Equal(planned) {
+		t.Fatalf("expect failed run pending retry, got %+v %v", record, err)
+	}
+
+	loop = startHourly(t, store, start.Add(time.Hour*5), &failures)
+	loop.Advance(time.Second)
+	loop.Cancel()
+	record, _, err = store.Load("hourly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.History) != 2 || record.History[1].Error != "" || !record.History[1].Planned.Equal(planned) {
+		t.Fatalf("expect catch-up of the failed run, got %+v", record.History)
+	}
+	if !record.LastRun.Equal(planned) || !record.NextRun.Equal(start.Add(time.Hour*6)) {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	store := NewMemoryStore()
+	loop := relay.StartSimLoop(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer loop.Cancel()
+	errs := make(chan error, 1)
+	loop.Execute(relay.ExecFunc(func() error {
+		cron, err := relay.NewCron("@hourly")
+		if err == nil {
+			scheduler := NewScheduler(store)
+			err = scheduler.Add("hourly", cron, AtLeastOnce, func() error {
+				return nil
+			})
+			if err == nil {
+				err = scheduler.Remove("hourly")
+			}
+		}
+		errs <- err
+		return nil
+	}))
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	loop.Flush()
+	if _, ok, err := store.Load("hourly"); ok || err != nil {
+		t.Fatalf("expect record removed from the store, got %t %v", ok, err)
+	}
+	if timers := loop.Timers(); len(timers) != 0 {
+		t.Fatalf("expect job timer unregistered, got %v", timers)
+	}
+}
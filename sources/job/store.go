@@ -0,0 +1,152 @@
+package job
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Run struct {
+	Planned time.Time `json:"planned"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type Record struct {
+	Name    string    `json:"name"`
+	LastRun time.Time `json:"last_run"`
+	NextRun time.Time `json:"next_run"`
+	Retry   time.Time `json:"retry"`
+	History []Run     `json:"history,omitempty"`
+}
+
+type Store interface {
+	Load(name string) (Record, bool, error)
+	Save(record Record) error
+	Delete(name string) error
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{records: make(map[string]Record)}
+}
+
+func NewFileStore(path string) (Store, error) {
+	store := &fileStore{path: path, records: make(map[string]Record)}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	if len(content) != 0 {
+		err = json.Unmarshal(content, &store.records)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return store, nil
+}
+
+type memoryStore struct {
+	guard   sync.Mutex
+	records map[string]Record
+}
+
+type fileStore struct {
+	guard   sync.Mutex
+	path    string
+	records map[string]Record
+}
+
+func (this *memoryStore) Load(name string) (Record, bool, error) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	record, ok := this.records[name]
+	return copyRecord(record), ok, nil
+}
+
+func (this *memoryStore) Save(record Record) error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	this.records[record.Name] = copyRecord(record)
+	return nil
+}
+
+func (this *memoryStore) Delete(name string) error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	delete(this.records, name)
+	return nil
+}
+
+func (this *fileStore) Load(name string) (Record, bool, error) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	record, ok := this.records[name]
+	return copyRecord(record), ok, nil
+}
+
+func (this *fileStore) Save(record Record) error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	previous, exists := this.records[record.Name]
+	this.records[record.Name] = copyRecord(record)
+	err := this.flush()
+	if err != nil {
+		if exists {
+			this.records[record.Name] = previous
+		} else {
+			delete(this.records, record.Name)
+		}
+	}
+	return err
+}
+
+func (this *fileStore) Delete(name string) error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	previous, exists := this.records[name]
+	if !exists {
+		return nil
+	}
+	delete(this.records, name)
+	err := this.flush()
+	if err != nil {
+		this.records[name] = previous
+	}
+	return err
+}
+
+func (this *fileStore) flush() error {
+	content, err := json.MarshalIndent(this.records, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(this.path), filepath.Base(this.path)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(file.Name(), this.path))
+}
+
+func copyRecord(record Record) Record {
+	record.History = append([]Run(nil), record.History...)
+	return record
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"context"
+	"relay/log"
+)
+
+type tasklocal struct {
+	key    any
+	value  any
+	parent *tasklocal
+}
+
+type inheritexecutor struct {
+	executor Executor
+	locals   *tasklocal
+}
+
+type taskcontext struct {
+	context.Context
+	locals *tasklocal
+}
+
+type loggerkey struct{}
+
+type tracekey struct{}
+
+func (this *inheritexecutor) Execute() error {
+	return this.executor.Execute()
+}
+
+func (this *loop) Value(key any) any {
+	if currentloop() == this {
+		locals := this.current.locals
+		if value, ok := locals.load(key); ok {
+			return value
+		}
+		if value, ok := locals.load(loggerkey{}); ok {
+			if result := value.(context.Context).Value(key); result != nil {
+				return result
+			}
+		}
+	}
+	return this.Context.Value(key)
+}
+
+func (this *taskcontext) Value(key any) any {
+	if value, ok := this.locals.load(key); ok {
+		return value
+	}
+	return this.Context.Value(key)
+}
+
+func (this *tasklocal) load(key any) (any, bool) {
+	for cursor := this; cursor != nil; cursor = cursor.parent {
+		if cursor.key == key {
+			return cursor.value, true
+		}
+	}
+	return nil, false
+}
+
+func (this *tasklocal) without(key any) *tasklocal {
+	if this == nil {
+		return nil
+	}
+	if this.key == key {
+		return this.parent
+	}
+	parent := this.parent.without(key)
+	if parent == this.parent {
+		return this
+	}
+	return &tasklocal{key: this.key, value: this.value, parent: parent}
+}
+
+func tasklocals() *tasklocal {
+	loop := currentloop()
+	if loop == nil || loop.current == nil {
+		return nil
+	}
+	return loop.current.locals
+}
+
+func inherit(executor Executor) Executor {
+	if _, ok := executor.(*inheritexecutor); ok {
+		return executor
+	}
+	locals := tasklocals()
+	if locals == nil {
+		return executor
+	}
+	return &inheritexecutor{executor: executor, locals: locals}
+}
+
+func TaskLoad(key any) (any, bool) {
+	loop := currentloop()
+	if loop == nil {
+		return nil, false
+	}
+	return loop.current.locals.load(key)
+}
+
+func TaskStore(key, value any) {
+	co := InLoop().(*loop).current
+	co.locals = &tasklocal{key: key, value: value, parent: co.locals.without(key)}
+}
+
+func TaskDelete(key any) {
+	co := InLoop().(*loop).current
+	co.locals = co.locals.without(key)
+}
+
+func TaskContext() context.Context {
+	loop := InLoop().(*loop)
+	return Logger().WithContext(&taskcontext{Context: loop.Context, locals: loop.current.locals})
+}
+
+func Logger() *log.Logger {
+	loop := currentloop()
+	if loop == nil {
+		return log.Ctx(Application)
+	}
+	return log.Ctx(loop)
+}
+
+func WithLogger(update func(log.Context) log.Context) {
+	logger := update(Logger().With()).Logger()
+	TaskStore(loggerkey{}, logger.WithContext(context.Background()))
+}
+
+func SetTraceID(id string) {
+	TaskStore(tracekey{}, id)
+	WithLogger(func(context log.Context) log.Context {
+		return context.Str("trace", id)
+	})
+}
+
+func TraceID() string {
+	value, ok := TaskLoad(tracekey{})
+	if !ok {
+		return ""
+	}
+	return value.(string)
+}
@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"relay/log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskLocal(t *testing.T) {
+	loop := StartLoop()
+	defer loop.Cancel()
+	results := make(chan any, 8)
+	loop.Execute(ExecFunc(func() error {
+		for i := 0; i < 100; i++ {
+			TaskStore("key", i)
+		}
+		TaskStore("other", "value")
+		length := 0
+		for cursor := currentloop().current.locals; cursor != nil; cursor = cursor.parent {
+			length++
+		}
+		results <- length
+		return InLoop().Execute(ExecFunc(func() error {
+			value, _ := TaskLoad("key")
+			results <- value
+			TaskDelete("other")
+			_, ok := TaskLoad("other")
+			results <- ok
+			return nil
+		}))
+	}))
+	loop.Execute(ExecFunc(func() error {
+		_, ok := TaskLoad("key")
+		results <- ok
+		return nil
+	}))
+	result := collect(t, results, 4)
+	if result[0] != 2 || result[1] != false || result[2] != 99 || result[3] != false {
+		t.Fatalf("unexpected results %v", result)
+	}
+}
+
+func TestMailboxTaskLocal(t *testing.T) {
+	loop := StartLoop()
+	defer loop.Cancel()
+	results := make(chan string, 8)
+	mailbox := startmailbox(t, loop, 0, func(value string) error {
+		results <- value + ":" + TraceID()
+		return nil
+	})
+	loop.Execute(ExecFunc(func() error {
+		SetTraceID("first")
+		mailbox.Post("a")
+		return InLoop().Execute(ExecFunc(func() error {
+			SetTraceID("second")
+			mailbox.Post("b")
+			return nil
+		}))
+	}))
+	result := collect(t, results, 2)
+	mailbox.Post("c")
+	result = append(result, collect(t, results, 1)...)
+	if strings.Join(result, " ") != "a:first b:second c:" {
+		t.Fatalf("expect locals captured per message, got %v", result)
+	}
+}
+
+func TestTraceLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	options := DefaultLoopOptions()
+	options.SetContext(log.New(&buffer).WithContext(context.Background()))
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	done := make(chan struct{})
+	loop.Execute(ExecFunc(func() error {
+		defer close(done)
+		SetTraceID("abc")
+		log.Ctx(InLoop()).Info().Msg("loop")
+		log.Ctx(TaskContext()).Info().Msg("task")
+		return nil
+	}))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output %q", buffer.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"trace":"abc"`) {
+			t.Fatalf("expect trace id in %s", line)
+		}
+	}
+	buffer.Reset()
+	log.Ctx(loop).Info().Msg("outside")
+	if strings.Contains(buffer.String(), "trace") {
+		t.Fatalf("expect trace logger limited to the task, got %s", buffer.String())
+	}
+}
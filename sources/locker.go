@@ -1,120 +1,520 @@
 package relay
 
 import (
+	gerrors "errors"
+	"fmt"
 	"reflect"
+	"relay/log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var ErrLockTimeout = gerrors.New("lock timeout")
+
+type DeadlockError struct {
+	Waits []LockWait
+}
+
+type LockStat struct {
+	Type      string
+	Held      int
+	Waiting   int
+	Acquired  uint64
+	Contended uint64
+	TimedOut  uint64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+type LockWait struct {
+	Loop string
+	Type string
+	Keys []any
+}
+
 func Lock[T comparable](first T, rest ...T) func() {
 	return Locks(append([]T{first}, rest...))
 }
 
 func Locks[T comparable](params []T) func() {
-	this := InLoop().(*loop)
-	typeof := reflect.TypeOf((*T)(nil)).Elem()
-	result := &lock[T]{values: params}
-	result.wait.Add(1)
-	if !result.tryLock(true) {
-		value, ok := typelists.Load(typeof)
-		if !ok {
-			value, _ = typelists.LoadOrStore(typeof, &typelist[T]{
-				locks: make(map[T]struct{}),
-				waits: make(map[T][]*lock[T]),
-			})
+	unlock, _ := acquire(params, false, true, 0)
+	return unlock
+}
+
+func RLock[T comparable](first T, rest ...T) func() {
+	return RLocks(append([]T{first}, rest...))
+}
+
+func RLocks[T comparable](params []T) func() {
+	unlock, _ := acquire(params, true, true, 0)
+	return unlock
+}
+
+func TryLock[T comparable](first T, rest ...T) (func(), bool) {
+	return TryLocks(append([]T{first}, rest...))
+}
+
+func TryLocks[T comparable](params []T) (func(), bool) {
+	unlock, err := acquire(params, false, false, 0)
+	return unlock, err == nil
+}
+
+func TryRLock[T comparable](first T, rest ...T) (func(), bool) {
+	return TryRLocks(append([]T{first}, rest...))
+}
+
+func TryRLocks[T comparable](params []T) (func(), bool) {
+	unlock, err := acquire(params, true, false, 0)
+	return unlock, err == nil
+}
+
+func LockTimeout[T comparable](timeout time.Duration, first T, rest ...T) (func(), error) {
+	return LocksTimeout(timeout, append([]T{first}, rest...))
+}
+
+func LocksTimeout[T comparable](timeout time.Duration, params []T) (func(), error) {
+	return acquire(params, false, timeout > 0, timeout)
+}
+
+func RLockTimeout[T comparable](timeout time.Duration, first T, rest ...T) (func(), error) {
+	return RLocksTimeout(timeout, append([]T{first}, rest...))
+}
+
+func RLocksTimeout[T comparable](timeout time.Duration, params []T) (func(), error) {
+	return acquire(params, true, timeout > 0, timeout)
+}
+
+func LockStats() []LockStat {
+	var result []LockStat
+	typelists.Range(func(key, value any) bool {
+		result = append(result, value.(locktype).stat())
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Type < result[j].Type
+	})
+	return result
+}
+
+func SetLockDebug(enable bool) {
+	if enable {
+		atomic.StoreInt32(&lockdebug, 1)
+	} else {
+		atomic.StoreInt32(&lockdebug, 0)
+	}
+}
+
+func (this *DeadlockError) Error() string {
+	var builder strings.Builder
+	builder.WriteString("deadlock detected: ")
+	for i, wait := range this.Waits {
+		if i > 0 {
+			builder.WriteString(" -> ")
 		}
-		addLock(value.(*typelist[T]), result, params)
+		builder.WriteString(fmt.Sprintf("loop %s waits for %s %v", wait.Loop, wait.Type, wait.Keys))
+	}
+	return builder.String()
+}
+
+func acquire[T comparable](params []T, shared bool, wait bool, timeout time.Duration) (func(), error) {
+	this := InLoop().(*loop)
+	list := gettypelist[T]()
+	owner := lockowner{co: this.current, generation: atomic.LoadUint64(&this.current.generation)}
+	result := &lock[T]{list: list, values: distinct(params), shared: shared, loop: this, owner: owner, since: this.timers.now()}
+	list.guard.Lock()
+	if list.grantable(result) {
+		list.take(result, 0)
+		list.guard.Unlock()
+		return result.unlock, nil
+	}
+	if !wait {
+		list.guard.Unlock()
+		return nil, ErrLockTimeout
 	}
 	co := this.current
-	this.current = nil
-	this.self.resume(nil)
-	result.wait.Wait()
-	this.list.pushfront(co.executor)
-	co.yield()
-	return func() {
-		value, ok := typelists.Load(typeof)
-		if ok {
-			list := value.(*typelist[T])
-			list.guard.Lock()
-			defer list.guard.Unlock()
-			for _, param := range params {
-				delete(list.locks, param)
+	result.state = lockwaiting
+	result.wake = func() {
+		this.list.pushfront(co.executor)
+	}
+	list.enqueue(result)
+	list.guard.Unlock()
+	if atomic.LoadInt32(&lockdebug) != 0 {
+		lockgraph.Lock()
+		co.waiting = result
+		lockgraph.Unlock()
+		defer func() {
+			lockgraph.Lock()
+			co.waiting = nil
+			lockgraph.Unlock()
+		}()
+		if err := detect(owner); err != nil {
+			log.Ctx(this).Error().Err(err).Msg("lock deadlock detected")
+			if timeout > 0 && result.abandon() {
+				return nil, err
 			}
-			for _, param := range params {
-				locks, ok := list.waits[param]
-				if ok {
-					for _, lock := range locks {
-						if lock.tryLock(false) {
-							break
-						}
-					}
+		}
+	}
+	var timer Timer
+	this.suspend(func(wake func()) {
+		if timeout > 0 {
+			timer = NewTimer(TimeoutFunc(func(Timer) error {
+				if result.abandon() {
+					wake()
 				}
+				return nil
+			}))
+			timer.StartNow(WithDelay(timeout))
+		}
+	})
+	if timer != nil {
+		timer.Stop()
+	}
+	if result.state == lockabandoned {
+		return nil, ErrLockTimeout
+	}
+	return result.unlock, nil
+}
+
+func distinct[T comparable](params []T) []T {
+	result := make([]T, 0, len(params))
+	for i, param := range params {
+		duplicate := false
+		for _, previous := range params[:i] {
+			if previous == param {
+				duplicate = true
+				break
 			}
 		}
+		if !duplicate {
+			result = append(result, param)
+		}
 	}
+	return result
 }
 
-func addLock[T comparable](list *typelist[T], result *lock[T], values []T) {
-	list.guard.Lock()
-	defer list.guard.Unlock()
-	for _, value := range values {
-		locks, ok := list.waits[value]
-		if ok {
-			locks = append(locks, result)
-		} else {
-			locks = []*lock[T]{result}
+func gettypelist[T comparable]() *typelist[T] {
+	typeof := reflect.TypeOf((*T)(nil)).Elem()
+	value, ok := typelists.Load(typeof)
+	if !ok {
+		value, _ = typelists.LoadOrStore(typeof, &typelist[T]{
+			name: typeof.String(),
+			keys: make(map[T]*lockkey[T]),
+		})
+	}
+	return value.(*typelist[T])
+}
+
+func detect(start lockowner) error {
+	lockgraph.Lock()
+	defer lockgraph.Unlock()
+	visited := make(map[lockowner]bool)
+	var path []LockWait
+	var visit func(owner lockowner) bool
+	visit = func(owner lockowner) bool {
+		if !owner.active() || owner.co.waiting == nil {
+			return false
+		}
+		wait, holders, ok := owner.co.waiting.blockers()
+		if !ok {
+			return false
 		}
-		list.waits[value] = locks
+		visited[owner] = true
+		path = append(path, wait)
+		for _, holder := range holders {
+			if holder == start {
+				return true
+			}
+			if !visited[holder] && visit(holder) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(start) {
+		return &DeadlockError{Waits: path}
 	}
+	return nil
 }
 
 var typelists sync.Map
+var lockdebug int32
+var lockgraph sync.Mutex
+
+type lockstate int
+
+const (
+	lockacquired lockstate = iota
+	lockwaiting
+	lockabandoned
+)
+
+type lockwaiter interface {
+	blockers() (LockWait, []lockowner, bool)
+}
+
+type lockowner struct {
+	co         *coroutine
+	generation uint64
+}
+
+type locktype interface {
+	stat() LockStat
+}
 
 type typelist[T comparable] struct {
-	guard sync.Mutex
-	locks map[T]struct{}
-	waits map[T][]*lock[T]
+	guard     sync.Mutex
+	name      string
+	keys      map[T]*lockkey[T]
+	held      int
+	waiting   int
+	seq       uint64
+	acquired  uint64
+	contended uint64
+	timedout  uint64
+	totalwait time.Duration
+	maxwait   time.Duration
+}
+
+type lockkey[T comparable] struct {
+	writer  *lock[T]
+	readers []*lock[T]
+	queue   []*lock[T]
 }
 
 type lock[T comparable] struct {
+	list   *typelist[T]
 	values []T
-	wait   sync.WaitGroup
+	shared bool
+	loop   *loop
+	owner  lockowner
+	since  time.Time
+	seq    uint64
+	state  lockstate
+	wake   func()
 }
 
-func (this *lock[T]) tryLock(guard bool) bool {
-	typeof := reflect.TypeOf((*T)(nil)).Elem()
-	value, ok := typelists.Load(typeof)
+func (this *typelist[T]) key(value T) *lockkey[T] {
+	key, ok := this.keys[value]
 	if !ok {
-		value, _ = typelists.LoadOrStore(typeof, &typelist[T]{
-			locks: make(map[T]struct{}),
-			waits: make(map[T][]*lock[T]),
-		})
+		key = &lockkey[T]{}
+		this.keys[value] = key
 	}
-	list := value.(*typelist[T])
-	if guard {
-		list.guard.Lock()
-		defer list.guard.Unlock()
+	return key
+}
+
+func (this *typelist[T]) cleanup(value T) {
+	key, ok := this.keys[value]
+	if ok && key.writer == nil && len(key.readers) == 0 && len(key.queue) == 0 {
+		delete(this.keys, value)
 	}
-	if len(list.locks) != 0 {
-		for _, value := range this.values {
-			_, exists := list.locks[value]
-			if exists {
+}
+
+func (this *typelist[T]) grantable(lock *lock[T]) bool {
+	for _, value := range lock.values {
+		key, ok := this.keys[value]
+		if !ok {
+			continue
+		}
+		if key.writer != nil || (!lock.shared && len(key.readers) != 0) {
+			return false
+		}
+		for _, ahead := range key.queue {
+			if ahead == lock {
+				break
+			}
+			if !lock.shared || !ahead.shared {
 				return false
 			}
 		}
 	}
-	for _, value := range this.values {
-		list.locks[value] = Void
-		locks, ok := list.waits[value]
-		if ok {
-			for i := 0; i < len(locks); i++ {
-				if locks[i] == this {
-					locks = append(locks[:i], locks[i+1:]...)
-					list.waits[value] = locks
-					break
-				}
+	return true
+}
+
+func (this *typelist[T]) take(lock *lock[T], wait time.Duration) {
+	lock.state = lockacquired
+	for _, value := range lock.values {
+		key := this.key(value)
+		if lock.shared {
+			key.readers = append(key.readers, lock)
+		} else {
+			key.writer = lock
+		}
+	}
+	this.held++
+	this.acquired++
+	if wait > 0 {
+		this.totalwait += wait
+		if wait > this.maxwait {
+			this.maxwait = wait
+		}
+	}
+}
+
+func (this *typelist[T]) release(lock *lock[T]) bool {
+	released := false
+	for _, value := range lock.values {
+		key, ok := this.keys[value]
+		if !ok {
+			continue
+		}
+		if key.writer == lock {
+			key.writer = nil
+			released = true
+		}
+		for i, reader := range key.readers {
+			if reader == lock {
+				key.readers = append(key.readers[:i], key.readers[i+1:]...)
+				released = true
+				break
+			}
+		}
+		this.cleanup(value)
+	}
+	if released {
+		this.held--
+	}
+	return released
+}
+
+func (this *typelist[T]) enqueue(lock *lock[T]) {
+	for _, value := range lock.values {
+		key := this.key(value)
+		key.queue = append(key.queue, lock)
+	}
+	this.seq++
+	lock.seq = this.seq
+	this.waiting++
+	this.contended++
+}
+
+func (this *typelist[T]) dequeue(lock *lock[T]) {
+	for _, value := range lock.values {
+		key, ok := this.keys[value]
+		if !ok {
+			continue
+		}
+		for i, queued := range key.queue {
+			if queued == lock {
+				key.queue = append(key.queue[:i], key.queue[i+1:]...)
+				break
 			}
 		}
+		this.cleanup(value)
+	}
+	this.waiting--
+}
+
+func (this *typelist[T]) wakeup(values []T) []func() {
+	var candidates []*lock[T]
+	for _, value := range values {
+		if key, ok := this.keys[value]; ok {
+			candidates = append(candidates, key.queue...)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].seq < candidates[j].seq
+	})
+	var wakes []func()
+	for _, lock := range candidates {
+		if lock.state != lockwaiting || !this.grantable(lock) {
+			continue
+		}
+		this.dequeue(lock)
+		this.take(lock, lock.loop.timers.now().Sub(lock.since))
+		wakes = append([]func(){lock.wake}, wakes...)
+	}
+	return wakes
+}
+
+func (this *typelist[T]) stat() LockStat {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	return LockStat{
+		Type:      this.name,
+		Held:      this.held,
+		Waiting:   this.waiting,
+		Acquired:  this.acquired,
+		Contended: this.contended,
+		TimedOut:  this.timedout,
+		TotalWait: this.totalwait,
+		MaxWait:   this.maxwait,
+	}
+}
+
+func (this *lock[T]) unlock() {
+	list := this.list
+	list.guard.Lock()
+	var wakes []func()
+	if list.release(this) {
+		wakes = list.wakeup(this.values)
+	}
+	list.guard.Unlock()
+	for _, wake := range wakes {
+		wake()
+	}
+}
+
+func (this *lock[T]) abandon() bool {
+	list := this.list
+	list.guard.Lock()
+	if this.state != lockwaiting {
+		list.guard.Unlock()
+		return false
+	}
+	this.state = lockabandoned
+	list.dequeue(this)
+	list.timedout++
+	wakes := list.wakeup(this.values)
+	list.guard.Unlock()
+	for _, wake := range wakes {
+		wake()
 	}
-	this.wait.Done()
 	return true
 }
+
+func (this lockowner) active() bool {
+	return atomic.LoadUint64(&this.co.generation) == this.generation
+}
+
+func (this *lock[T]) blockers() (LockWait, []lockowner, bool) {
+	list := this.list
+	list.guard.Lock()
+	defer list.guard.Unlock()
+	if this.state != lockwaiting {
+		return LockWait{}, nil, false
+	}
+	wait := LockWait{Loop: this.loop.name, Type: list.name}
+	var holders []lockowner
+	for _, value := range this.values {
+		key, ok := list.keys[value]
+		if !ok {
+			continue
+		}
+		var blocking []*lock[T]
+		if key.writer != nil {
+			blocking = append(blocking, key.writer)
+		}
+		if !this.shared {
+			blocking = append(blocking, key.readers...)
+		}
+		for _, ahead := range key.queue {
+			if ahead == this {
+				break
+			}
+			if !this.shared || !ahead.shared {
+				blocking = append(blocking, ahead)
+			}
+		}
+		if len(blocking) != 0 {
+			wait.Keys = append(wait.Keys, value)
+			for _, lock := range blocking {
+				holders = append(holders, lock.owner)
+			}
+		}
+	}
+	return wait, holders, true
+}
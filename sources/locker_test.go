@@ -0,0 +1,206 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type testlockkey int
+
+func TestTryLockAndTimeout(t *testing.T) {
+	loop := StartSimLoop(time.Unix(0, 0))
+	defer loop.Cancel()
+	results := make(chan error, 4)
+	loop.Execute(ExecFunc(func() error {
+		unlock := Lock(testlockkey(1), testlockkey(2))
+		if _, ok := TryLock(testlockkey(2)); ok {
+			results <- errors.New("expect try lock to fail")
+		}
+		After(time.Second*3, func() error {
+			unlock()
+			return nil
+		})
+		return nil
+	}))
+	loop.Execute(ExecFunc(func() error {
+		_, err := LockTimeout(time.Second, testlockkey(1))
+		results <- err
+		unlock, err := LockTimeout(time.Second*5, testlockkey(1))
+		if err == nil {
+			if Now().Sub(time.Unix(0, 0)) != time.Second*3 {
+				err = errors.Errorf("expect lock at 3s, got %v", Now())
+			}
+			unlock()
+		}
+		results <- err
+		return nil
+	}))
+	loop.Advance(time.Second * 10)
+	if err := <-results; err != ErrLockTimeout {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+	loop.Execute(ExecFunc(func() error {
+		unlock, ok := TryLock(testlockkey(1), testlockkey(2))
+		if ok {
+			unlock()
+			results <- nil
+		} else {
+			results <- errors.New("expect keys to be free")
+		}
+		return nil
+	}))
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockDeadlock(t *testing.T) {
+	SetLockDebug(true)
+	defer SetLockDebug(false)
+	first := StartLoop()
+	second := StartLoop()
+	defer first.Cancel()
+	defer second.Cancel()
+	held := make(chan struct{}, 2)
+	proceed := make(chan struct{})
+	results := make(chan error, 2)
+	run := func(loop Loop, own, want testlockkey, timeout time.Duration) {
+		loop.Execute(ExecFunc(func() error {
+			unlock := Lock(own)
+			defer unlock()
+			held <- struct{}{}
+			Poll(proceed)
+			other, err := LockTimeout(timeout, want)
+			if err == nil {
+				other()
+			}
+			results <- err
+			return nil
+		}))
+	}
+	run(first, 10, 11, time.Minute)
+	run(second, 11, 10, time.Minute)
+	<-held
+	<-held
+	close(proceed)
+	var deadlock *DeadlockError
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil && !errors.As(err, &deadlock) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("deadlock was not detected")
+		}
+	}
+	if deadlock == nil || len(deadlock.Waits) != 2 {
+		t.Fatalf("expect a deadlock between two loops, got %v", deadlock)
+	}
+}
+
+func TestLockDeadlockReusedCoroutine(t *testing.T) {
+	SetLockDebug(true)
+	defer SetLockDebug(false)
+	first := StartLoop()
+	second := StartLoop()
+	defer first.Cancel()
+	defer second.Cancel()
+	stashed := make(chan func(), 1)
+	first.Execute(ExecFunc(func() error {
+		stashed <- Lock(testlockkey(20))
+		return nil
+	}))
+	unlock := <-stashed
+	defer unlock()
+	held := make(chan struct{}, 2)
+	proceed := make(chan struct{})
+	results := make(chan error, 2)
+	second.Execute(ExecFunc(func() error {
+		unlock := Lock(testlockkey(22))
+		defer unlock()
+		held <- struct{}{}
+		Poll(proceed)
+		_, err := LockTimeout(time.Millisecond*200, testlockkey(20))
+		results <- err
+		return nil
+	}))
+	first.Execute(ExecFunc(func() error {
+		held <- struct{}{}
+		Poll(proceed)
+		Sleep(time.Millisecond * 50)
+		unlock, err := LockTimeout(time.Second, testlockkey(22))
+		if err == nil {
+			unlock()
+		}
+		results <- err
+		return nil
+	}))
+	<-held
+	<-held
+	close(proceed)
+	for _, expect := range []error{ErrLockTimeout, nil} {
+		select {
+		case err := <-results:
+			if err != expect {
+				t.Fatalf("expect %v, got %v", expect, err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+type testrwkey int
+
+func TestReadWriteLockFairness(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var order []string
+	before := rwstat()
+	acquire := func(name string, shared bool, d time.Duration, keys ...testrwkey) {
+		loop.Execute(ExecFunc(func() error {
+			var unlock func()
+			if shared {
+				unlock = RLocks(keys)
+			} else {
+				unlock = Locks(keys)
+			}
+			order = append(order, name+"@"+Now().Sub(start).String())
+			err := Sleep(d)
+			unlock()
+			return err
+		}))
+		loop.Flush()
+	}
+	acquire("r1", true, time.Second*2, 1)
+	acquire("r2", true, time.Second*3, 1)
+	acquire("w1", false, time.Second, 1, 2)
+	acquire("r3", true, time.Second, 1)
+	acquire("r4", true, time.Second, 2)
+	loop.Advance(time.Second * 10)
+	expect := []string{"r1@0s", "r2@0s", "w1@3s", "r3@4s", "r4@4s"}
+	if !reflect.DeepEqual(order, expect) {
+		t.Fatalf("expect %v, got %v", expect, order)
+	}
+	stat := rwstat()
+	if stat.Acquired-before.Acquired != 5 || stat.Contended-before.Contended != 3 || stat.Held != 0 || stat.Waiting != 0 || stat.MaxWait != time.Second*4 {
+		t.Fatalf("unexpected stat %+v", stat)
+	}
+}
+
+func rwstat() LockStat {
+	for _, stat := range LockStats() {
+		if stat.Type == "relay.testrwkey" {
+			return stat
+		}
+	}
+	return LockStat{}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"reflect"
 	"relay/internal/g"
+	"relay/log"
+	"sort"
 	"sync"
 	"sync/atomic"
-	"unsafe"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -25,12 +27,25 @@ type Loop interface {
 	Delete(key any)
 }
 
+type LoopInspector interface {
+	Name() string
+	Stats() LoopStats
+	Timers() []TimerInfo
+}
+
 type ExecFunc func() error
 
 func (this ExecFunc) Execute() error {
 	return this()
 }
 
+func LoopName(loop Loop) string {
+	if inspector, ok := loop.(LoopInspector); ok {
+		return inspector.Name()
+	}
+	return ""
+}
+
 func InLoop() Loop {
 	loop := currentloop()
 	if loop == nil {
@@ -40,7 +55,11 @@ func InLoop() Loop {
 }
 
 func IsInLoop() Loop {
-	return currentloop()
+	loop := currentloop()
+	if loop == nil {
+		return nil
+	}
+	return loop
 }
 
 func Poll[T any](ch <-chan T) (result T, err error) {
@@ -61,9 +80,10 @@ func Poll[T any](ch <-chan T) (result T, err error) {
 	}()
 	co := this.current
 	this.current = nil
+	this.list.leave()
 	this.self.resume(nil)
 	result = <-ch
-	this.list.pushfront(co.executor)
+	this.list.pushreturn(co.executor)
 	co.yield()
 	return
 }
@@ -72,9 +92,10 @@ func Await(action any, params ...any) ([]any, error) {
 	this := InLoop().(*loop)
 	co := this.current
 	this.current = nil
+	this.list.leave()
 	this.self.resume(nil)
 	results, err := protect(action, params...)
-	this.list.pushfront(co.executor)
+	this.list.pushreturn(co.executor)
 	co.yield()
 	return results, err
 }
@@ -157,21 +178,55 @@ func protect(action any, params ...any) (results []any, err error) {
 }
 
 func StartLoop(errors ...func(error) error) Loop {
-	context, cancel := context.WithCancel(Application)
-	result := &loop{Context: context, cancel: cancel, errors: errors, self: coroutine{signal: make(chan Executor)}}
-	result.list.init()
+	options := DefaultLoopOptions()
+	options.SetErrorHandlers(errors...)
+	return StartLoopWith(options)
+}
+
+func StartLoopWith(options LoopOptions) Loop {
+	return startloop(options, nil)
+}
+
+func startloop(options LoopOptions, timers timerdriver) *loop {
+	if !options.enable {
+		options = DefaultLoopOptions()
+	}
+	name := options.name
+	if name == "" {
+		name = fmt.Sprintf("loop-%d", atomic.AddUint32(&loopindex, 1))
+	}
+	parent := options.parent
+	if parent == nil {
+		parent = Application
+	}
+	logger := log.Ctx(parent).With().Str("loop", name).Logger()
+	context, cancel := context.WithCancel(logger.WithContext(parent))
+	result := &loop{Context: context, cancel: cancel, name: name, timers: timers, errors: options.errors, panic: options.panic, maxCoroutines: int32(options.maxCoroutines), self: coroutine{signal: make(chan Executor)}}
+	if timers == nil {
+		result.timers = newwheeltimers(result, options.clock)
+	}
+	result.list.init(options.maxPending, options.overflow)
 	loops.Add(1)
+	runningloops.Store(result, Void)
 	go func() {
-		defer result.list.pushback(nil)
+		defer result.list.pushurgent(nil)
 		<-context.Done()
 	}()
 	go func() {
 		defer loops.Done()
+		defer result.list.stop()
+		defer runningloops.Delete(result)
 		for {
-			executor := result.list.pop()
+			executor := result.list.pop(result.available)
 			if executor == nil {
 				break
 			}
+			if resume, ok := executor.(*resumer); ok {
+				result.current = resume.co
+				resume.co.resume(nil)
+				result.self.yield()
+				continue
+			}
 			if result.Err() != nil {
 				break
 			}
@@ -180,12 +235,22 @@ func StartLoop(errors ...func(error) error) Loop {
 			co.resume(executor)
 			result.self.yield()
 		}
+		for {
+			co := result.unpause()
+			if co == nil {
+				break
+			}
+			result.current = co
+			co.resume(nil)
+			result.self.yield()
+		}
 		for {
 			var co *coroutine
 			result.lock.Lock()
 			if result.freelist != nil {
 				co = result.freelist
 				result.freelist = co.next
+				result.idle--
 			}
 			result.lock.Unlock()
 			if co == nil {
@@ -198,21 +263,43 @@ func StartLoop(errors ...func(error) error) Loop {
 	return result
 }
 
+func RunningLoops() []Loop {
+	var result []Loop
+	runningloops.Range(func(key, value any) bool {
+		result = append(result, key.(*loop))
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return LoopName(result[i]) < LoopName(result[j])
+	})
+	return result
+}
+
 type loop struct {
 	context.Context
-	cancel   context.CancelFunc
-	errors   []func(error) error
-	values   sync.Map
-	list     tasklist
-	lock     sync.Mutex
-	count    int32
-	self     coroutine
-	current  *coroutine
-	freelist *coroutine
+	cancel        context.CancelFunc
+	name          string
+	timers        timerdriver
+	timernames    sync.Map
+	errors        []func(error) error
+	panic         PanicPolicy
+	maxCoroutines int32
+	values        sync.Map
+	list          tasklist
+	lock          sync.Mutex
+	count         int32
+	idle          int32
+	self          coroutine
+	current       *coroutine
+	freelist      *coroutine
+	paused        map[*coroutine]struct{}
 }
 
 func currentloop() *loop {
 	pointer := g.Get()
+	if pointer == 0 {
+		return nil
+	}
 	value, ok := goloops.Load(pointer)
 	if !ok {
 		return nil
@@ -221,17 +308,50 @@ func currentloop() *loop {
 	if !ok {
 		return nil
 	}
-	if loop.current == nil || loop.current.pointer != pointer {
+	if loop.current == nil || loop.current.pointer != pointer || loop.current.thread != g.Thread() {
 		return nil
 	}
 	return loop
 }
 
+func (this *loop) Name() string {
+	return this.name
+}
+
 func (this *loop) Cancel() {
 	this.cancel()
 }
 
 func (this *loop) Execute(executor Executor) error {
+	if executor == nil {
+		return nil
+	}
+	_, pinned := executor.(pinnedexecutor)
+	executor = inherit(executor)
+	for {
+		err := this.Err()
+		if err != nil {
+			return err
+		}
+		space, err := this.list.pushback(executor, pinned)
+		if space == nil {
+			return err
+		}
+		wait := func() {
+			select {
+			case <-space:
+			case <-this.Done():
+			}
+		}
+		if current := currentloop(); current != nil {
+			current.park(wait)
+		} else {
+			wait()
+		}
+	}
+}
+
+func (this *loop) ExecuteUrgent(executor Executor) error {
 	if executor == nil {
 		return nil
 	}
@@ -239,10 +359,29 @@ func (this *loop) Execute(executor Executor) error {
 	if err != nil {
 		return err
 	}
-	this.list.pushback(executor)
+	this.list.pushurgent(inherit(executor))
 	return nil
 }
 
+func (this *loop) Stats() LoopStats {
+	result := this.list.stats()
+	result.Name = this.name
+	result.Coroutines = int(atomic.LoadInt32(&this.count))
+	return result
+}
+
+func (this *loop) Timers() []TimerInfo {
+	var result []TimerInfo
+	this.timernames.Range(func(key, value any) bool {
+		result = append(result, value.(*timer).info())
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
 func (this *loop) Load(key any) (any, bool) {
 	return this.values.Load(key)
 }
@@ -256,9 +395,62 @@ func (this *loop) Delete(key any) {
 }
 
 func (this *loop) DebugPrint() {
-	this.list.guard.Lock()
-	defer this.list.guard.Unlock()
-	fmt.Println(fmt.Sprintf("pending: %d", this.list.len))
+	stats := this.Stats()
+	fmt.Println(fmt.Sprintf("%s pending: %d, coroutines: %d, urgent: %d, dropped: %d, rejected: %d", stats.Name, stats.Pending, stats.Coroutines, stats.Urgent, stats.Dropped, stats.Rejected))
+	for _, timer := range this.Timers() {
+		fmt.Println(fmt.Sprintf("timer %s running: %t, next: %s, remaining: %s", timer.Name, timer.Running, timer.Next.Format(time.RFC3339), timer.Remaining))
+	}
+}
+
+func (this *loop) park(wait func()) {
+	co := this.current
+	this.current = nil
+	this.list.leave()
+	this.self.resume(nil)
+	wait()
+	this.list.pushreturn(co.executor)
+	co.yield()
+}
+
+func (this *loop) suspend(arm func(wake func())) {
+	co := this.current
+	arm(func() {
+		this.list.pushfront(co.executor)
+	})
+	this.current = nil
+	this.self.resume(nil)
+	co.yield()
+}
+
+func (this *loop) pause(arm func(wake func())) {
+	co := this.current
+	this.lock.Lock()
+	if this.paused == nil {
+		this.paused = make(map[*coroutine]struct{})
+	}
+	this.paused[co] = Void
+	this.lock.Unlock()
+	this.suspend(func(wake func()) {
+		arm(func() {
+			this.lock.Lock()
+			_, ok := this.paused[co]
+			delete(this.paused, co)
+			this.lock.Unlock()
+			if ok {
+				wake()
+			}
+		})
+	})
+}
+
+func (this *loop) unpause() *coroutine {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for co := range this.paused {
+		delete(this.paused, co)
+		return co
+	}
+	return nil
 }
 
 func (this *loop) getfree() *coroutine {
@@ -267,19 +459,15 @@ func (this *loop) getfree() *coroutine {
 	if this.freelist != nil {
 		co := this.freelist
 		this.freelist = co.next
+		this.idle--
 		return co
 	}
 	co := &coroutine{signal: make(chan Executor)}
-	co.executor = ExecFunc(func() error {
-		this.current = co
-		co.resume(nil)
-		this.self.yield()
-		return nil
-	})
+	co.executor = &resumer{loop: this, co: co}
 	atomic.AddInt32(&this.count, 1)
 	wait := make(chan struct{})
 	go func() {
-		co.pointer = g.Get()
+		co.pointer = g.Bind()
 		goloops.Store(co.pointer, this)
 		wait <- Void
 		defer func() {
@@ -288,7 +476,7 @@ func (this *loop) getfree() *coroutine {
 			this.self.resume(nil)
 			if result := recover(); result != nil {
 				if wrap, ok := result.(errorWrap); ok {
-					errloop <- wrap.err
+					this.fail(wrap.err)
 				} else {
 					if err, ok := result.(error); ok {
 						for _, error := range this.errors {
@@ -298,10 +486,12 @@ func (this *loop) getfree() *coroutine {
 							}
 						}
 						if err != nil {
-							errloop <- err
+							this.fail(err)
 						}
-					} else {
+					} else if this.panic == PanicShutdown {
 						panic(result)
+					} else {
+						this.fail(errors.Errorf("%v", result))
 					}
 				}
 			}
@@ -311,6 +501,17 @@ func (this *loop) getfree() *coroutine {
 			if executor == nil {
 				break
 			}
+			co.locals = nil
+			atomic.AddUint64(&co.generation, 1)
+			if g.Get() != co.pointer {
+				goloops.Delete(co.pointer)
+				co.pointer = g.Bind()
+				goloops.Store(co.pointer, this)
+			}
+			if inherit, ok := executor.(*inheritexecutor); ok {
+				co.locals = inherit.locals
+				executor = inherit.executor
+			}
 			err := executor.Execute()
 			if err != nil {
 				for _, error := range this.errors {
@@ -320,7 +521,10 @@ func (this *loop) getfree() *coroutine {
 					}
 				}
 				if err != nil {
-					panic(errorWrap{err})
+					if this.panic == PanicShutdown {
+						panic(errorWrap{err})
+					}
+					this.fail(err)
 				}
 			}
 			this.putfree(co)
@@ -332,37 +536,99 @@ func (this *loop) getfree() *coroutine {
 	return co
 }
 
+func (this *loop) available(urgent bool) bool {
+	limit := this.maxCoroutines
+	if urgent {
+		limit++
+	}
+	if this.maxCoroutines <= 0 || atomic.LoadInt32(&this.count) < limit {
+		return true
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return atomic.LoadInt32(&this.count)-this.idle < limit
+}
+
+func (this *loop) fail(err error) {
+	switch this.panic {
+	case PanicRecover:
+		log.Ctx(this).Error().Err(err).Msg("loop task failed")
+	case PanicCancel:
+		log.Ctx(this).Error().Err(err).Msg("loop task failed, cancel loop")
+		this.Cancel()
+	default:
+		errloop <- errors.WithMessagef(err, "loop %s", this.name)
+	}
+}
+
 func (this *loop) putfree(co *coroutine) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	co.next = this.freelist
 	this.freelist = co
+	this.idle++
 }
 
 type errorWrap struct {
 	err error
 }
 
+type resumer struct {
+	loop *loop
+	co   *coroutine
+}
+
+func (this *resumer) Execute() error {
+	this.loop.current = this.co
+	this.co.resume(nil)
+	this.loop.self.yield()
+	return nil
+}
+
 type coroutine struct {
-	pointer  unsafe.Pointer
-	signal   chan Executor
-	executor Executor
-	next     *coroutine
+	generation uint64
+	pointer    uintptr
+	thread     uintptr
+	signal     chan Executor
+	executor   Executor
+	locals     *tasklocal
+	waiting    lockwaiter
+	next       *coroutine
 }
 
 func (this *coroutine) yield() Executor {
-	return <-this.signal
+	executor := <-this.signal
+	if this.pointer != 0 {
+		this.thread = g.Enter()
+	}
+	return executor
 }
 
 func (this *coroutine) resume(executor Executor) {
+	if this.pointer == 0 {
+		g.Leave()
+	}
 	this.signal <- executor
 }
 
 type tasklist struct {
-	root   tasknode
-	len    int
-	guard  sync.Mutex
-	signal *sync.Cond
+	lanes    [2]tasklane
+	max      int
+	overflow Overflow
+	dropped  uint64
+	rejected uint64
+	guard    sync.Mutex
+	signal   *sync.Cond
+	idle     *sync.Cond
+	waiting  bool
+	stopped  bool
+	away     int
+	space    chan struct{}
+}
+
+type tasklane struct {
+	root tasknode
+	len  int
 }
 
 type tasknode struct {
@@ -370,6 +636,21 @@ type tasknode struct {
 	prev     *tasknode
 	next     *tasknode
 	executor Executor
+	pinned   bool
+}
+
+type pinnedexecutor interface {
+	Executor
+	pinned()
+}
+
+type pinnedfunc func() error
+
+func (this pinnedfunc) Execute() error {
+	return this()
+}
+
+func (this pinnedfunc) pinned() {
 }
 
 var taskfreelist = sync.Pool{
@@ -378,51 +659,173 @@ var taskfreelist = sync.Pool{
 	},
 }
 
-func (this *tasklist) init() {
-	this.root.next = &this.root
-	this.root.prev = &this.root
-	this.len = 0
+const (
+	urgentlane = iota
+	normallane
+)
+
+func (this *tasklist) init(max int, overflow Overflow) {
+	for i := range this.lanes {
+		lane := &this.lanes[i]
+		lane.root.next = &lane.root
+		lane.root.prev = &lane.root
+		lane.len = 0
+	}
+	this.max = max
+	this.overflow = overflow
 	this.signal = sync.NewCond(&this.guard)
+	this.idle = sync.NewCond(&this.guard)
+}
+
+func (this *tasklist) leave() {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	this.away++
+}
+
+func (this *tasklist) pushreturn(executor Executor) {
+	node := taskfreelist.Get().(*tasknode)
+	node.executor = executor
+	this.guard.Lock()
+	this.away--
+	lane := &this.lanes[urgentlane]
+	this.insert(lane, node, &lane.root)
+}
+
+func (this *tasklist) stop() {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	this.stopped = true
+	this.idle.Broadcast()
+}
+
+func (this *tasklist) waitidle() {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	for !this.stopped && (!this.waiting || this.away != 0) {
+		this.idle.Wait()
+	}
 }
 
 func (this *tasklist) pushfront(executor Executor) {
 	node := taskfreelist.Get().(*tasknode)
 	node.executor = executor
 	this.guard.Lock()
-	this.insert(node, &this.root)
+	lane := &this.lanes[urgentlane]
+	this.insert(lane, node, &lane.root)
 }
 
-func (this *tasklist) pushback(executor Executor) {
+func (this *tasklist) pushurgent(executor Executor) {
 	node := taskfreelist.Get().(*tasknode)
 	node.executor = executor
 	this.guard.Lock()
-	this.insert(node, this.root.prev)
+	lane := &this.lanes[urgentlane]
+	this.insert(lane, node, lane.root.prev)
+}
+
+func (this *tasklist) pushback(executor Executor, pinned bool) (chan struct{}, error) {
+	this.guard.Lock()
+	lane := &this.lanes[normallane]
+	if this.max > 0 && lane.len >= this.max {
+		overflow := this.overflow
+		var oldest *tasknode
+		if overflow == OverflowDropOldest {
+			for oldest = lane.root.next; oldest != &lane.root && oldest.pinned; oldest = oldest.next {
+			}
+			if oldest == &lane.root {
+				overflow = OverflowReject
+			}
+		}
+		switch overflow {
+		case OverflowReject:
+			this.rejected++
+			this.guard.Unlock()
+			return nil, ErrLoopFull
+		case OverflowDropOldest:
+			this.dropped++
+			this.remove(lane, oldest).recycle()
+		default:
+			if this.space == nil {
+				this.space = make(chan struct{})
+			}
+			space := this.space
+			this.guard.Unlock()
+			return space, nil
+		}
+	}
+	node := taskfreelist.Get().(*tasknode)
+	node.executor = executor
+	node.pinned = pinned
+	this.insert(lane, node, lane.root.prev)
+	return nil, nil
 }
 
-func (this *tasklist) insert(node, at *tasknode) {
+func (this *tasklist) insert(lane *tasklane, node, at *tasknode) {
 	node.prev = at
 	node.next = at.next
 	at.next = node
 	node.next.prev = node
 	node.list = this
-	this.len++
+	lane.len++
+	this.waiting = false
 	this.guard.Unlock()
 	this.signal.Signal()
 }
 
-func (this *tasklist) pop() Executor {
+func (this *tasklist) remove(lane *tasklane, node *tasknode) *tasknode {
+	lane.len--
+	node.prev.next = node.next
+	node.next.prev = node.prev
+	if lane == &this.lanes[normallane] && this.space != nil {
+		close(this.space)
+		this.space = nil
+	}
+	return node
+}
+
+func (this *tasklist) pop(available func(urgent bool) bool) Executor {
 	this.guard.Lock()
 	defer this.guard.Unlock()
-	for this.len == 0 {
+	for {
+		lane, node := this.next(available)
+		if node != nil {
+			executor := this.remove(lane, node).executor
+			node.recycle()
+			return executor
+		}
+		this.waiting = true
+		if this.away == 0 {
+			this.idle.Broadcast()
+		}
 		this.signal.Wait()
 	}
-	this.len--
-	node := this.root.next
-	node.prev.next = node.next
-	node.next.prev = node.prev
-	executor := node.executor
-	node.recycle()
-	return executor
+}
+
+func (this *tasklist) next(available func(urgent bool) bool) (*tasklane, *tasknode) {
+	lane := &this.lanes[urgentlane]
+	spare := true
+	for node := lane.root.next; node != &lane.root; node = node.next {
+		if _, ok := node.executor.(*resumer); ok || node.executor == nil || spare && available(true) {
+			return lane, node
+		}
+		spare = false
+	}
+	lane = &this.lanes[normallane]
+	if lane.len == 0 || !available(false) {
+		return nil, nil
+	}
+	return lane, lane.root.next
+}
+
+func (this *tasklist) stats() LoopStats {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	return LoopStats{
+		Pending:  this.lanes[normallane].len,
+		Urgent:   this.lanes[urgentlane].len,
+		Dropped:  this.dropped,
+		Rejected: this.rejected,
+	}
 }
 
 func (this *tasknode) recycle() {
@@ -430,6 +833,7 @@ func (this *tasknode) recycle() {
 	this.prev = nil
 	this.list = nil
 	this.executor = nil
+	this.pinned = false
 	taskfreelist.Put(this)
 }
 
@@ -439,3 +843,5 @@ type stackTracer interface {
 
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
 var goloops sync.Map
+var runningloops sync.Map
+var loopindex uint32
@@ -0,0 +1,404 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIsInLoop(t *testing.T) {
+	if IsInLoop() != nil {
+		t.Fatal("expect no loop outside of a loop")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expect InLoop to panic outside of a loop")
+			}
+		}()
+		InLoop()
+	}()
+
+	first := StartLoop()
+	second := StartLoop()
+	defer first.Cancel()
+	defer second.Cancel()
+	results := make(chan Loop, 4)
+	first.Execute(ExecFunc(func() error {
+		results <- IsInLoop()
+		results <- InLoop()
+		done := make(chan Loop)
+		go func() {
+			done <- IsInLoop()
+		}()
+		results <- <-done
+		return second.Execute(ExecFunc(func() error {
+			results <- IsInLoop()
+			return nil
+		}))
+	}))
+	expects := []Loop{first, first, nil, second}
+	for i, expect := range expects {
+		select {
+		case result := <-results:
+			if result != expect {
+				t.Fatalf("result %d: expect %v, got %v", i, expect, result)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("result %d: timeout", i)
+		}
+	}
+}
+
+func TestIsInLoopAfterPoll(t *testing.T) {
+	loop := StartLoop()
+	defer loop.Cancel()
+	results := make(chan Loop, 2)
+	loop.Execute(ExecFunc(func() error {
+		ch := make(chan int, 1)
+		go func() {
+			ch <- 1
+		}()
+		_, err := Poll(ch)
+		if err != nil {
+			return err
+		}
+		results <- IsInLoop()
+		_, err = Await(func() {
+			results <- IsInLoop()
+		})
+		return err
+	}))
+	expects := []Loop{loop, nil}
+	for i, expect := range expects {
+		select {
+		case result := <-results:
+			if result != expect {
+				t.Fatalf("result %d: expect %v, got %v", i, expect, result)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("result %d: timeout", i)
+		}
+	}
+}
+
+func blockloop(t *testing.T, loop Loop) chan struct{} {
+	gate := make(chan struct{})
+	entered := make(chan struct{})
+	loop.Execute(ExecFunc(func() error {
+		close(entered)
+		<-gate
+		return nil
+	}))
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return gate
+}
+
+func collect[T any](t *testing.T, results chan T, count int) []T {
+	var result []T
+	for i := 0; i < count; i++ {
+		select {
+		case value := <-results:
+			result = append(result, value)
+		case <-time.After(time.Second):
+			t.Fatalf("result %d: timeout", i)
+		}
+	}
+	return result
+}
+
+func TestLoopOverflow(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetMaxPending(2, OverflowReject)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	gate := blockloop(t, loop)
+	results := make(chan int, 8)
+	for i := 0; i < 3; i++ {
+		value := i
+		err := loop.Execute(ExecFunc(func() error {
+			results <- value
+			return nil
+		}))
+		if i < 2 && err != nil {
+			t.Fatalf("task %d: %v", i, err)
+		}
+		if i == 2 && err != ErrLoopFull {
+			t.Fatalf("expect loop full, got %v", err)
+		}
+	}
+	if stats := loop.(LoopInspector).Stats(); stats.Pending != 2 || stats.Rejected != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	close(gate)
+	if result := collect(t, results, 2); result[0] != 0 || result[1] != 1 {
+		t.Fatalf("unexpected order %v", result)
+	}
+
+	options = DefaultLoopOptions()
+	options.SetMaxPending(2, OverflowDropOldest)
+	loop = StartLoopWith(options)
+	defer loop.Cancel()
+	gate = blockloop(t, loop)
+	loop.Execute(pinnedfunc(func() error {
+		results <- -1
+		return nil
+	}))
+	for i := 0; i < 3; i++ {
+		value := i
+		if err := loop.Execute(ExecFunc(func() error {
+			results <- value
+			return nil
+		})); err != nil {
+			t.Fatalf("task %d: %v", i, err)
+		}
+	}
+	if stats := loop.(LoopInspector).Stats(); stats.Pending != 2 || stats.Dropped != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	close(gate)
+	if result := collect(t, results, 2); result[0] != -1 || result[1] != 2 {
+		t.Fatalf("expect pinned task to survive drop oldest, got %v", result)
+	}
+}
+
+func TestLoopOverflowBlock(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetMaxPending(1, OverflowBlock)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	gate := blockloop(t, loop)
+	results := make(chan int, 8)
+	loop.Execute(ExecFunc(func() error {
+		results <- 0
+		return nil
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- loop.Execute(ExecFunc(func() error {
+			results <- 1
+			return nil
+		}))
+	}()
+	select {
+	case <-done:
+		t.Fatal("expect Execute to block while the loop is full")
+	case <-time.After(time.Millisecond * 20):
+	}
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if result := collect(t, results, 2); result[0] != 0 || result[1] != 1 {
+		t.Fatalf("unexpected order %v", result)
+	}
+}
+
+func TestLoopExecuteUrgent(t *testing.T) {
+	loop := startloop(DefaultLoopOptions(), nil)
+	defer loop.Cancel()
+	gate := blockloop(t, loop)
+	results := make(chan string, 8)
+	for _, value := range []string{"normal-1", "normal-2"} {
+		value := value
+		loop.Execute(ExecFunc(func() error {
+			results <- value
+			return nil
+		}))
+	}
+	for _, value := range []string{"urgent-1", "urgent-2"} {
+		value := value
+		loop.ExecuteUrgent(ExecFunc(func() error {
+			results <- value
+			return nil
+		}))
+	}
+	if stats := loop.Stats(); stats.Pending != 2 || stats.Urgent != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	close(gate)
+	result := collect(t, results, 4)
+	for i, expect := range []string{"urgent-1", "urgent-2", "normal-1", "normal-2"} {
+		if result[i] != expect {
+			t.Fatalf("expect %v, got %v", expect, result)
+		}
+	}
+}
+
+func TestLoopUrgentMaxCoroutines(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetMaxCoroutines(1)
+	loop := startloop(options, nil)
+	defer loop.Cancel()
+	results := make(chan string, 32)
+	release := make(chan struct{})
+	loop.Execute(ExecFunc(func() error {
+		results <- "parked"
+		_, err := Poll(release)
+		return err
+	}))
+	if result := collect(t, results, 1); result[0] != "parked" {
+		t.Fatalf("unexpected result %v", result)
+	}
+	for i := 0; i < 20; i++ {
+		loop.ExecuteUrgent(ExecFunc(func() error {
+			results <- "urgent"
+			_, err := Poll(release)
+			return err
+		}))
+	}
+	collect(t, results, 1)
+	select {
+	case result := <-results:
+		t.Fatalf("expect urgent work to wait for a coroutine, got %v", result)
+	case <-time.After(time.Millisecond * 50):
+	}
+	if stats := loop.Stats(); stats.Coroutines != 2 || stats.Urgent != 19 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	close(release)
+	collect(t, results, 19)
+	if stats := loop.Stats(); stats.Coroutines > 2 {
+		t.Fatalf("expect at most one reserved coroutine past the cap, got %d", stats.Coroutines)
+	}
+}
+
+func TestLoopMaxCoroutines(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetMaxCoroutines(1).SetMaxPending(2, OverflowReject)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	results := make(chan string, 32)
+	release := make(chan struct{})
+	loop.Execute(ExecFunc(func() error {
+		results <- "parked"
+		_, err := Poll(release)
+		results <- "resumed"
+		return err
+	}))
+	if result := collect(t, results, 1); result[0] != "parked" {
+		t.Fatalf("unexpected result %v", result)
+	}
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		if loop.Execute(ExecFunc(func() error {
+			results <- "task"
+			return nil
+		})) == nil {
+			accepted++
+		}
+	}
+	if accepted != 2 {
+		t.Fatalf("expect pending bound to hold while coroutines are exhausted, accepted %d", accepted)
+	}
+	select {
+	case result := <-results:
+		t.Fatalf("expect no task to start while the coroutine is parked, got %s", result)
+	case <-time.After(time.Millisecond * 20):
+	}
+	close(release)
+	result := collect(t, results, 3)
+	if result[0] != "resumed" || result[1] != "task" || result[2] != "task" {
+		t.Fatalf("unexpected order %v", result)
+	}
+	if stats := loop.(LoopInspector).Stats(); stats.Coroutines != 1 || stats.Rejected != 18 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLoopPanicPolicy(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetPanicPolicy(PanicRecover)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	results := make(chan string, 4)
+	loop.Execute(ExecFunc(func() error {
+		panic("boom")
+	}))
+	loop.Execute(ExecFunc(func() error {
+		results <- "after"
+		return nil
+	}))
+	if result := collect(t, results, 1); result[0] != "after" || loop.Err() != nil {
+		t.Fatalf("expect loop to keep running after a recovered panic, got %v %v", result, loop.Err())
+	}
+
+	options = DefaultLoopOptions()
+	options.SetPanicPolicy(PanicCancel)
+	loop = StartLoopWith(options)
+	loop.Execute(ExecFunc(func() error {
+		panic("boom")
+	}))
+	select {
+	case <-loop.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect loop to be cancelled after a panic")
+	}
+}
+
+func TestNamedLoop(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	options := DefaultLoopOptions()
+	options.SetName("test-named").SetContext(parent)
+	loop := StartLoopWith(options)
+	if name := LoopName(loop); name != "test-named" {
+		t.Fatalf("expect test-named, got %s", name)
+	}
+	other := StartLoop()
+	defer other.Cancel()
+	if LoopName(other) == "" {
+		t.Fatal("expect generated loop name")
+	}
+	found := false
+	for _, running := range RunningLoops() {
+		if running == loop {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expect loop in RunningLoops")
+	}
+	cancel()
+	select {
+	case <-loop.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect loop to stop with its parent context")
+	}
+	deadline := time.Now().Add(time.Second)
+	for found && time.Now().Before(deadline) {
+		found = false
+		for _, running := range RunningLoops() {
+			if running == loop {
+				found = true
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if found {
+		t.Fatal("expect stopped loop removed from RunningLoops")
+	}
+}
+
+func TestLoopMaxCoroutinesSleep(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetMaxCoroutines(1)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	results := make(chan error, 1)
+	loop.Execute(ExecFunc(func() error {
+		results <- Sleep(time.Millisecond * 10)
+		return nil
+	}))
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer could not run while every coroutine sleeps")
+	}
+}
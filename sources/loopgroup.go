@@ -0,0 +1,185 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+type LoopGroup interface {
+	Len() int
+	Loops() []Loop
+	Select(key any) Loop
+	Next() Loop
+	Execute(key any, executor Executor) error
+	Broadcast(executor Executor) error
+	Cancel()
+}
+
+func StartLoopGroup(n int, errors ...func(error) error) LoopGroup {
+	options := DefaultLoopOptions()
+	options.SetErrorHandlers(errors...)
+	return StartLoopGroupWith(n, options)
+}
+
+func StartLoopGroupWith(n int, options LoopOptions) LoopGroup {
+	loops := make([]Loop, n)
+	name := options.name
+	for i := 0; i < n; i++ {
+		if name != "" {
+			options.SetName(fmt.Sprintf("%s-%d", name, i))
+		}
+		loops[i] = StartLoopWith(options)
+	}
+	return NewLoopGroup(loops...)
+}
+
+func NewLoopGroup(loops ...Loop) LoopGroup {
+	if len(loops) == 0 {
+		panic(errors.New("loop group is empty"))
+	}
+	result := &loopgroup{loops: loops, ring: make([]loopring, 0, len(loops)*loopreplicas)}
+	var bytes [8]byte
+	for i := range loops {
+		for j := 0; j < loopreplicas; j++ {
+			binary.BigEndian.PutUint32(bytes[:4], uint32(i))
+			binary.BigEndian.PutUint32(bytes[4:], uint32(j))
+			result.ring = append(result.ring, loopring{hash: hashbytes(bytes[:]), index: i})
+		}
+	}
+	sort.Slice(result.ring, func(i, j int) bool {
+		return result.ring[i].hash < result.ring[j].hash
+	})
+	return result
+}
+
+type loopgroup struct {
+	loops []Loop
+	ring  []loopring
+	next  uint32
+}
+
+type loopring struct {
+	hash  uint64
+	index int
+}
+
+func (this *loopgroup) Len() int {
+	return len(this.loops)
+}
+
+func (this *loopgroup) Loops() []Loop {
+	return append([]Loop(nil), this.loops...)
+}
+
+func (this *loopgroup) Select(key any) Loop {
+	hash := hashkey(key)
+	index := sort.Search(len(this.ring), func(i int) bool {
+		return this.ring[i].hash >= hash
+	})
+	if index == len(this.ring) {
+		index = 0
+	}
+	return this.loops[this.ring[index].index]
+}
+
+func (this *loopgroup) Next() Loop {
+	index := atomic.AddUint32(&this.next, 1) - 1
+	return this.loops[index%uint32(len(this.loops))]
+}
+
+func (this *loopgroup) Execute(key any, executor Executor) error {
+	return this.Select(key).Execute(executor)
+}
+
+func (this *loopgroup) Broadcast(executor Executor) error {
+	var result error
+	for _, loop := range this.loops {
+		err := loop.Execute(executor)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (this *loopgroup) Cancel() {
+	for _, loop := range this.loops {
+		loop.Cancel()
+	}
+}
+
+func hashkey(key any) uint64 {
+	var bytes [8]byte
+	switch value := key.(type) {
+	case nil:
+		return 0
+	case string:
+		return hashstring(value)
+	case []byte:
+		return hashbytes(value)
+	case int:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case int8:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case int16:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case int32:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case int64:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case uint:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case uint8:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case uint16:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case uint32:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case uint64:
+		binary.BigEndian.PutUint64(bytes[:], value)
+	case uintptr:
+		binary.BigEndian.PutUint64(bytes[:], uint64(value))
+	case float32:
+		binary.BigEndian.PutUint64(bytes[:], math.Float64bits(float64(value)))
+	case float64:
+		binary.BigEndian.PutUint64(bytes[:], math.Float64bits(value))
+	case bool:
+		if value {
+			bytes[7] = 1
+		}
+	case fmt.Stringer:
+		return hashstring(value.String())
+	default:
+		return hashstring(fmt.Sprint(value))
+	}
+	return hashbytes(bytes[:])
+}
+
+func hashstring(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	return mixhash(hash.Sum64())
+}
+
+func hashbytes(value []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(value)
+	return mixhash(hash.Sum64())
+}
+
+func mixhash(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+const loopreplicas = 64
@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoopGroupSelect(t *testing.T) {
+	group := StartLoopGroup(4)
+	defer group.Cancel()
+	counts := make(map[Loop]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("player-%d", i)
+		loop := group.Select(key)
+		if group.Select(key) != loop {
+			t.Fatalf("key %s selected different loops", key)
+		}
+		counts[loop]++
+	}
+	if len(counts) != 4 {
+		t.Fatalf("expect keys spread over 4 loops, got %d", len(counts))
+	}
+	for loop, count := range counts {
+		if count < 100 {
+			t.Fatalf("loop %s only got %d keys", LoopName(loop), count)
+		}
+	}
+
+	grown := NewLoopGroup(append(group.Loops(), StartLoop())...)
+	defer grown.Loops()[4].Cancel()
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("player-%d", i)
+		if grown.Select(key) != group.Select(key) {
+			moved++
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Fatalf("expect about a fifth of the keys to move, got %d", moved)
+	}
+}
+
+func TestLoopGroupExecute(t *testing.T) {
+	group := StartLoopGroup(3)
+	defer group.Cancel()
+	results := make(chan Loop, 8)
+	for i := 0; i < 3; i++ {
+		expect := group.Next()
+		if expect != group.Loops()[i] {
+			t.Fatalf("Next %d: expect %s, got %s", i, LoopName(group.Loops()[i]), LoopName(expect))
+		}
+	}
+	err := group.Execute(42, ExecFunc(func() error {
+		results <- IsInLoop()
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-results:
+		if result != group.Select(42) {
+			t.Fatalf("expect task on %s, got %s", LoopName(group.Select(42)), LoopName(result))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	err = group.Broadcast(ExecFunc(func() error {
+		results <- IsInLoop()
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[Loop]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case result := <-results:
+			seen[result] = true
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expect broadcast on every loop, got %d", len(seen))
+	}
+}
@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"context"
+	gerrors "errors"
+)
+
+var ErrLoopFull = gerrors.New("loop full")
+
+type Overflow int
+
+const (
+	OverflowBlock Overflow = iota
+	OverflowReject
+	OverflowDropOldest
+)
+
+type PanicPolicy int
+
+const (
+	PanicShutdown PanicPolicy = iota
+	PanicCancel
+	PanicRecover
+)
+
+type LoopOptions struct {
+	enable        bool
+	name          string
+	parent        context.Context
+	errors        []func(error) error
+	maxPending    int
+	overflow      Overflow
+	maxCoroutines int
+	panic         PanicPolicy
+	clock         Clock
+}
+
+type LoopStats struct {
+	Name       string
+	Coroutines int
+	Pending    int
+	Urgent     int
+	Dropped    uint64
+	Rejected   uint64
+}
+
+func DefaultLoopOptions() LoopOptions {
+	return LoopOptions{
+		enable:   true,
+		overflow: OverflowBlock,
+		panic:    PanicShutdown,
+	}
+}
+
+func (this *LoopOptions) SetName(name string) *LoopOptions {
+	this.name = name
+	return this
+}
+
+func (this *LoopOptions) SetContext(parent context.Context) *LoopOptions {
+	this.parent = parent
+	return this
+}
+
+func (this *LoopOptions) SetErrorHandlers(errors ...func(error) error) *LoopOptions {
+	this.errors = errors
+	return this
+}
+
+func (this *LoopOptions) SetClock(clock Clock) *LoopOptions {
+	this.clock = clock
+	return this
+}
+
+func (this *LoopOptions) SetMaxPending(size int, overflow Overflow) *LoopOptions {
+	if size >= 0 {
+		this.maxPending = size
+		this.overflow = overflow
+	}
+	return this
+}
+
+func (this *LoopOptions) SetMaxCoroutines(size int) *LoopOptions {
+	if size >= 0 {
+		this.maxCoroutines = size
+	}
+	return this
+}
+
+func (this *LoopOptions) SetPanicPolicy(policy PanicPolicy) *LoopOptions {
+	this.panic = policy
+	return this
+}
@@ -0,0 +1,282 @@
+package relay
+
+import (
+	gerrors "errors"
+	"relay/log"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrMailboxFull = gerrors.New("mailbox full")
+var ErrMailboxClosed = gerrors.New("mailbox closed")
+
+const defaultMailboxBatch = 64
+
+type Mailbox[T any] struct {
+	loop     Loop
+	handler  func(T) error
+	capacity int
+	batch    int
+	guard    sync.Mutex
+	items    []mailboxitem[T]
+	head     int
+	flag     bool
+	closed   bool
+	space    chan struct{}
+	done     chan struct{}
+	execute  Executor
+}
+
+type mailboxitem[T any] struct {
+	value  T
+	locals *tasklocal
+}
+
+type Request[Req, Resp any] struct {
+	Value Req
+	reply chan response[Resp]
+}
+
+type response[Resp any] struct {
+	value Resp
+	err   error
+}
+
+func NewMailbox[T any](capacity int, handler func(T) error) *Mailbox[T] {
+	result := &Mailbox[T]{loop: InLoop(), handler: handler, capacity: capacity, batch: defaultMailboxBatch, done: make(chan struct{})}
+	result.execute = pinnedfunc(result.drain)
+	return result
+}
+
+func NewResponder[Req, Resp any](capacity int, handler func(Req) (Resp, error)) *Mailbox[*Request[Req, Resp]] {
+	return NewMailbox(capacity, func(request *Request[Req, Resp]) error {
+		defer func() {
+			if r := recover(); r != nil {
+				var empty Resp
+				if err, ok := r.(error); ok {
+					request.Reply(empty, err)
+				} else {
+					request.Reply(empty, errors.Errorf("%v", r))
+				}
+				panic(r)
+			}
+		}()
+		request.Reply(handler(request.Value))
+		return nil
+	})
+}
+
+func Ask[Req, Resp any](target *Mailbox[*Request[Req, Resp]], value Req) (Resp, error) {
+	request := &Request[Req, Resp]{Value: value, reply: make(chan response[Resp], 1)}
+	err := target.Send(request)
+	if err != nil {
+		var empty Resp
+		return empty, err
+	}
+	var result response[Resp]
+	wait := func() {
+		select {
+		case result = <-request.reply:
+		case <-target.done:
+			result.err = ErrMailboxClosed
+		case <-target.loop.Done():
+			result.err = target.loop.Err()
+		}
+	}
+	if current := currentloop(); current != nil {
+		current.park(wait)
+	} else {
+		wait()
+	}
+	return result.value, result.err
+}
+
+func (this *Request[Req, Resp]) Reply(value Resp, err error) {
+	select {
+	case this.reply <- response[Resp]{value, err}:
+	default:
+	}
+}
+
+func (this *Mailbox[T]) Loop() Loop {
+	return this.loop
+}
+
+func (this *Mailbox[T]) SetBatch(size int) *Mailbox[T] {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if size > 0 {
+		this.batch = size
+	}
+	return this
+}
+
+func (this *Mailbox[T]) Len() int {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	return len(this.items) - this.head
+}
+
+func (this *Mailbox[T]) Post(value T) error {
+	this.guard.Lock()
+	if this.closed {
+		this.guard.Unlock()
+		return ErrMailboxClosed
+	}
+	if this.capacity > 0 && len(this.items)-this.head >= this.capacity {
+		this.guard.Unlock()
+		return ErrMailboxFull
+	}
+	return this.push(value)
+}
+
+func (this *Mailbox[T]) Send(value T) error {
+	for {
+		this.guard.Lock()
+		if this.closed {
+			this.guard.Unlock()
+			return ErrMailboxClosed
+		}
+		if this.capacity <= 0 || len(this.items)-this.head < this.capacity {
+			return this.push(value)
+		}
+		if this.space == nil {
+			this.space = make(chan struct{})
+		}
+		space := this.space
+		this.guard.Unlock()
+		wait := func() {
+			select {
+			case <-space:
+			case <-this.done:
+			case <-this.loop.Done():
+			}
+		}
+		if current := currentloop(); current != nil {
+			current.park(wait)
+		} else {
+			wait()
+		}
+		if err := this.loop.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (this *Mailbox[T]) Close() {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if this.closed {
+		return
+	}
+	this.closed = true
+	this.items = nil
+	this.head = 0
+	close(this.done)
+	if this.space != nil {
+		close(this.space)
+		this.space = nil
+	}
+}
+
+func (this *Mailbox[T]) push(value T) error {
+	if this.head != 0 && this.head*2 >= len(this.items) {
+		length := copy(this.items, this.items[this.head:])
+		for i := length; i < len(this.items); i++ {
+			this.items[i] = mailboxitem[T]{}
+		}
+		this.items = this.items[:length]
+		this.head = 0
+	}
+	offset := len(this.items) - this.head
+	this.items = append(this.items, mailboxitem[T]{value: value, locals: tasklocals()})
+	schedule := !this.flag
+	this.flag = true
+	this.guard.Unlock()
+	if schedule {
+		err := this.loop.Execute(this.execute)
+		if err != nil {
+			this.guard.Lock()
+			this.flag = false
+			if !this.closed {
+				index := this.head + offset
+				copy(this.items[index:], this.items[index+1:])
+				this.items[len(this.items)-1] = mailboxitem[T]{}
+				this.items = this.items[:len(this.items)-1]
+			}
+			this.guard.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Mailbox[T]) drain() error {
+	co := currentloop().current
+	var failed error
+	for {
+		inline := false
+		err := func() error {
+			defer func() {
+				co.locals = nil
+				inline = this.reschedule()
+			}()
+			return this.receive(co)
+		}()
+		if failed == nil {
+			failed = err
+		}
+		if !inline {
+			return failed
+		}
+	}
+}
+
+func (this *Mailbox[T]) receive(co *coroutine) error {
+	this.guard.Lock()
+	batch := this.batch
+	this.guard.Unlock()
+	for i := 0; i < batch; i++ {
+		this.guard.Lock()
+		if this.closed || this.head == len(this.items) {
+			this.guard.Unlock()
+			return nil
+		}
+		item := this.items[this.head]
+		this.items[this.head] = mailboxitem[T]{}
+		this.head++
+		if this.space != nil {
+			close(this.space)
+			this.space = nil
+		}
+		this.guard.Unlock()
+		co.locals = item.locals
+		if err := this.handler(item.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Mailbox[T]) reschedule() bool {
+	this.guard.Lock()
+	pending := !this.closed && this.head != len(this.items)
+	this.flag = pending
+	this.guard.Unlock()
+	if !pending {
+		return false
+	}
+	err := this.loop.Execute(this.execute)
+	if err == nil {
+		return false
+	}
+	if this.loop.Err() == nil {
+		return true
+	}
+	this.guard.Lock()
+	this.flag = false
+	this.guard.Unlock()
+	log.Ctx(this.loop).Warn().Err(err).Msg("mailbox drain not rescheduled, loop stopped")
+	return false
+}
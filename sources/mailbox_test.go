@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func startmailbox[T any](t *testing.T, loop Loop, capacity int, handler func(T) error) *Mailbox[T] {
+	results := make(chan *Mailbox[T], 1)
+	loop.Execute(ExecFunc(func() error {
+		results <- NewMailbox(capacity, handler)
+		return nil
+	}))
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+		return nil
+	}
+}
+
+func TestMailboxBackpressure(t *testing.T) {
+	loop := StartLoop()
+	defer loop.Cancel()
+	gate := make(chan struct{})
+	entered := make(chan struct{}, 8)
+	handled := make(chan int, 8)
+	mailbox := startmailbox(t, loop, 2, func(value int) error {
+		entered <- struct{}{}
+		<-gate
+		handled <- value
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		if err := mailbox.Post(i); err != nil {
+			t.Fatalf("post %d: %v", i, err)
+		}
+		if i == 0 {
+			<-entered
+		}
+	}
+	if err := mailbox.Post(3); err != ErrMailboxFull {
+		t.Fatalf("expect mailbox full, got %v", err)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- mailbox.Send(3)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expect Send to block while the mailbox is full")
+	case <-time.After(time.Millisecond * 20):
+	}
+	close(gate)
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case value := <-handled:
+			if value != i {
+				t.Fatalf("expect %d, got %d", i, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	mailbox.Close()
+	if err := mailbox.Post(4); err != ErrMailboxClosed {
+		t.Fatalf("expect mailbox closed, got %v", err)
+	}
+}
+
+func TestMailboxAsk(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetPanicPolicy(PanicRecover)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	results := make(chan *Mailbox[*Request[int, int]], 1)
+	loop.Execute(ExecFunc(func() error {
+		results <- NewResponder(0, func(value int) (int, error) {
+			if value < 0 {
+				panic("negative")
+			}
+			return value * 2, nil
+		})
+		return nil
+	}))
+	responder := <-results
+	value, err := Ask(responder, 21)
+	if err != nil || value != 42 {
+		t.Fatalf("expect 42, got %d %v", value, err)
+	}
+	other := StartLoop()
+	defer other.Cancel()
+	done := make(chan error, 1)
+	other.Execute(ExecFunc(func() error {
+		_, err := Ask(responder, -1)
+		done <- err
+		return nil
+	}))
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "negative" {
+			t.Fatalf("expect panic as error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Ask hangs after the handler panicked")
+	}
+	value, err = Ask(responder, 1)
+	if err != nil || value != 2 {
+		t.Fatalf("expect mailbox to keep serving after a panic, got %d %v", value, err)
+	}
+}
+
+func TestMailboxBatch(t *testing.T) {
+	loop := StartLoop()
+	defer loop.Cancel()
+	order := make(chan string, 16)
+	mailbox := startmailbox(t, loop, 0, func(value string) error {
+		order <- value
+		return nil
+	})
+	mailbox.SetBatch(2)
+	loop.Execute(ExecFunc(func() error {
+		for _, value := range []string{"a", "b", "c", "d"} {
+			mailbox.Post(value)
+		}
+		return loop.Execute(ExecFunc(func() error {
+			order <- "task"
+			return nil
+		}))
+	}))
+	var result []string
+	for i := 0; i < 5; i++ {
+		select {
+		case value := <-order:
+			result = append(result, value)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	if result[2] != "task" {
+		t.Fatalf("expect other task to run between drain batches, got %v", result)
+	}
+}
+
+func TestMailboxRescheduleRejected(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetMaxPending(1, OverflowReject)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	handled := make(chan string, 8)
+	var mailbox *Mailbox[string]
+	mailbox = startmailbox(t, loop, 0, func(value string) error {
+		if value == "a" {
+			loop.Execute(ExecFunc(func() error {
+				return nil
+			}))
+		}
+		handled <- value
+		return nil
+	})
+	mailbox.SetBatch(1)
+	loop.Execute(ExecFunc(func() error {
+		mailbox.Post("a")
+		mailbox.Post("b")
+		return nil
+	}))
+	for _, expect := range []string{"a", "b"} {
+		select {
+		case value := <-handled:
+			if value != expect {
+				t.Fatalf("expect %s, got %s", expect, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("mailbox stalled after rejected reschedule")
+		}
+	}
+	if loop.(LoopInspector).Stats().Rejected == 0 {
+		t.Fatal("expect drain reschedule to be rejected")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if err := mailbox.Post("c"); err != nil {
+		t.Fatal(err)
+	}
+	if value := collect(t, handled, 1)[0]; value != "c" {
+		t.Fatalf("expect c, got %s", value)
+	}
+}
+
+func TestMailboxPostRejected(t *testing.T) {
+	options := DefaultLoopOptions()
+	options.SetMaxPending(1, OverflowReject)
+	loop := StartLoopWith(options)
+	defer loop.Cancel()
+	handled := make(chan string, 8)
+	mailbox := startmailbox(t, loop, 0, func(value string) error {
+		handled <- value
+		return nil
+	})
+	gate := blockloop(t, loop)
+	if err := loop.Execute(ExecFunc(func() error {
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailbox.Post("lost"); err != ErrLoopFull {
+		t.Fatalf("expect loop full, got %v", err)
+	}
+	if mailbox.Len() != 0 {
+		t.Fatalf("expect rejected message to be removed, got %d", mailbox.Len())
+	}
+	close(gate)
+	time.Sleep(time.Millisecond * 10)
+	if err := mailbox.Post("kept"); err != nil {
+		t.Fatal(err)
+	}
+	if value := collect(t, handled, 1)[0]; value != "kept" {
+		t.Fatalf("expect rejected message never handled, got %s", value)
+	}
+	select {
+	case value := <-handled:
+		t.Fatalf("unexpected %s", value)
+	case <-time.After(time.Millisecond * 20):
+	}
+}
@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"net"
+	"relay"
 	"time"
 )
 
@@ -18,6 +19,8 @@ type Option struct {
 	maxReadPacket  int
 	maxWritePacket int
 	keepAlive      time.Duration
+	group          relay.LoopGroup
+	route          func(*net.TCPConn) any
 }
 
 func DefaultOption() Option {
@@ -55,6 +58,25 @@ func (this *Option) SetKeepAlive(duration time.Duration) {
 	this.keepAlive = duration
 }
 
+func (this *Option) SetLoopGroup(group relay.LoopGroup, route func(*net.TCPConn) any) *Option {
+	this.group = group
+	this.route = route
+	return this
+}
+
+func (this *Option) selectLoop(loop relay.Loop, conn *net.TCPConn) relay.Loop {
+	if this.group == nil {
+		return loop
+	}
+	if this.route != nil {
+		return this.group.Select(this.route(conn))
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return this.group.Select(addr.IP.String())
+	}
+	return this.group.Select(conn.RemoteAddr().String())
+}
+
 func (this *Option) apply(conn *net.TCPConn) {
 	conn.SetNoDelay(this.noDelay)
 }
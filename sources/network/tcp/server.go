@@ -37,7 +37,7 @@ func Bind[TInput, TOutput any](option Option,
 	if !option.enable {
 		option = DefaultOption()
 	}
-	return &server[TInput, TOutput]{state: int32(network.Stopped), encoder: encoder, decoder: decoder, handle: handle, bufferpool: relay.NewBufferPool(option.bufferSize)}
+	return &server[TInput, TOutput]{state: int32(network.Stopped), option: option, encoder: encoder, decoder: decoder, handle: handle, bufferpool: relay.NewBufferPool(option.bufferSize)}
 }
 
 func (this *server[TInput, TOutput]) Start(address string) error {
@@ -103,9 +103,10 @@ func (this *server[TInput, TOutput]) accept() {
 		}
 		connTcp := conn.(*net.TCPConn)
 		this.option.apply(connTcp)
-		session := &session[TInput, TOutput]{loop: this.loop, conn: connTcp, option: this.option, encoder: this.encoder, decoder: this.decoder, handle: this.handle, bufferpool: this.bufferpool}
+		loop := this.option.selectLoop(this.loop, connTcp)
+		session := &session[TInput, TOutput]{loop: loop, conn: connTcp, option: this.option, encoder: this.encoder, decoder: this.decoder, handle: this.handle, bufferpool: this.bufferpool}
 		session.init()
-		this.loop.Execute(relay.ExecFunc(func() error {
+		loop.Execute(relay.ExecFunc(func() error {
 			return this.handle.OnAccept(session)
 		}))
 	}
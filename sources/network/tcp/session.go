@@ -1,7 +1,6 @@
 package tcp
 
 import (
-	"io"
 	"net"
 	"relay"
 	"relay/codec"
@@ -19,6 +18,8 @@ type session[TInput, TOutput any] struct {
 	flagMessage int32
 	execMessage relay.Executor
 	exit        sync.WaitGroup
+	closed      chan struct{}
+	closeOnce   sync.Once
 	values      sync.Map
 	readList    chan TInput
 	writeList   chan TOutput
@@ -64,25 +65,20 @@ func (this sessionInput[TInput, TOutput]) Alloc() relay.Buffer {
 	return this.session.bufferpool.New()
 }
 
+func (this sessionInput[TInput, TOutput]) Writer() codec.PipelineContext[relay.Buffer] {
+	return this.session.writeCtx
+}
+
 func (this sessionOutput[TInput, TOutput]) Next(output relay.Buffer) error {
 	for !output.Empty() {
-		bytes, err := output.BeginRead()
+		_, err := output.WriteTo(this.session.conn)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		n, err := this.session.conn.Write(bytes)
-		if err != nil {
-			output.EndRead(0)
 			if netErr, ok := err.(net.Error); ok && !netErr.Timeout() && netErr.Temporary() {
 				time.Sleep(time.Millisecond)
 				continue
 			}
 			return err
 		}
-		output.EndRead(n)
 	}
 	return nil
 }
@@ -111,6 +107,7 @@ func (this *session[TInput, TOutput]) init() {
 	if !this.option.enable {
 		this.option = DefaultOption()
 	}
+	this.closed = make(chan struct{})
 	this.readList = make(chan TInput, this.option.maxReadPacket)
 	this.writeList = make(chan TOutput, this.option.maxWritePacket)
 	this.readCtx = sessionInput[TInput, TOutput]{session: this}
@@ -144,6 +141,7 @@ func (this *session[TInput, TOutput]) Start() error {
 
 func (this *session[TInput, TOutput]) Close() error {
 	if atomic.CompareAndSwapInt32(&this.runflag, 1, 2) {
+		this.shutdown()
 		this.conn.CloseRead()
 		err := this.conn.SetReadDeadline(time.Now())
 		if err != nil {
@@ -179,11 +177,22 @@ func (this *session[TInput, TOutput]) message() {
 	}
 }
 
+func (this *session[TInput, TOutput]) shutdown() {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+}
+
 func (this *session[TInput, TOutput]) cleanup() {
 	this.exit.Wait()
 	atomic.StoreInt32(&this.runflag, 2)
 	this.loop.Execute(relay.ExecFunc(func() error {
 		err := this.handle.OnClose(this)
+		this.values.Range(func(key, value any) bool {
+			codec.Release(key, value)
+			this.values.Delete(key)
+			return true
+		})
 		go this.conn.Close()
 		return err
 	}))
@@ -192,7 +201,16 @@ func (this *session[TInput, TOutput]) cleanup() {
 func (this *session[TInput, TOutput]) write() {
 	defer this.exit.Done()
 	for {
-		output := <-this.writeList
+		var output TOutput
+		select {
+		case output = <-this.writeList:
+		case <-this.closed:
+			select {
+			case output = <-this.writeList:
+			default:
+				return
+			}
+		}
 		err := this.encoder(this.writeCtx, output)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok {
@@ -219,10 +237,15 @@ func (this *session[TInput, TOutput]) write() {
 func (this *session[TInput, TOutput]) read() {
 	defer this.exit.Done()
 	buffer := this.bufferpool.New()
+	defer buffer.Reset()
 	for {
 		bytes, err := buffer.BeginWrite()
+		if err == relay.ErrBufferBudget && relay.WaitBufferBudget(int64(this.option.bufferSize), this.closed) {
+			continue
+		}
 		if err != nil {
 			this.conn.SetWriteDeadline(time.Now())
+			this.shutdown()
 			break
 		}
 		keepAlive := false
@@ -241,10 +264,12 @@ func (this *session[TInput, TOutput]) read() {
 				continue
 			}
 			this.conn.SetWriteDeadline(time.Now())
+			this.shutdown()
 			break
 		}
 		if !buffer.EndWrite(n) {
 			this.conn.SetWriteDeadline(time.Now())
+			this.shutdown()
 			break
 		}
 		err = this.decoder(this.readCtx, buffer)
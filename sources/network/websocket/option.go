@@ -1,6 +1,9 @@
 package websocket
 
 import (
+	"net"
+	"net/http"
+	"relay"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,6 +23,8 @@ type Option struct {
 	maxReadPacket  int
 	maxWritePacket int
 	keepAlive      time.Duration
+	group          relay.LoopGroup
+	route          func(*http.Request) any
 }
 
 func DefaultOption() Option {
@@ -60,6 +65,25 @@ func (this *Option) SetKeepAlive(duration time.Duration) {
 	this.keepAlive = duration
 }
 
+func (this *Option) SetLoopGroup(group relay.LoopGroup, route func(*http.Request) any) *Option {
+	this.group = group
+	this.route = route
+	return this
+}
+
+func (this *Option) selectLoop(loop relay.Loop, r *http.Request) relay.Loop {
+	if this.group == nil {
+		return loop
+	}
+	if this.route != nil {
+		return this.group.Select(this.route(r))
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return this.group.Select(host)
+	}
+	return this.group.Select(r.RemoteAddr)
+}
+
 func (this *Option) apply(conn *websocket.Conn) {
 	conn.SetReadLimit(int64(this.maxPacketSize))
 }
@@ -47,7 +47,7 @@ func Bind[TInput, TOutput any](option Option,
 			return true
 		},
 	}
-	return &server[TInput, TOutput]{state: int32(network.Stopped), upgrader: upgrader, encoder: encoder, decoder: decoder, handle: handle, bufferpool: relay.NewBufferPool(option.bufferSize)}
+	return &server[TInput, TOutput]{state: int32(network.Stopped), option: option, upgrader: upgrader, encoder: encoder, decoder: decoder, handle: handle, bufferpool: relay.NewBufferPool(option.bufferSize)}
 }
 
 func (this *server[TInput, TOutput]) Start(address string) error {
@@ -88,9 +88,10 @@ func (this *server[TInput, TOutput]) Start(address string) error {
 			return
 		}
 		this.option.apply(conn)
-		session := &session[TInput, TOutput]{loop: this.loop, conn: conn, url: r.URL, header: r.Header, option: this.option, encoder: this.encoder, decoder: this.decoder, handle: this.handle, bufferpool: this.bufferpool}
+		loop := this.option.selectLoop(this.loop, r)
+		session := &session[TInput, TOutput]{loop: loop, conn: conn, url: r.URL, header: r.Header, option: this.option, encoder: this.encoder, decoder: this.decoder, handle: this.handle, bufferpool: this.bufferpool}
 		session.init()
-		this.loop.Execute(relay.ExecFunc(func() error {
+		loop.Execute(relay.ExecFunc(func() error {
 			return this.handle.OnAccept(session)
 		}))
 	})}
@@ -44,6 +44,8 @@ type session[TInput, TOutput any] struct {
 	flagMessage int32
 	execMessage relay.Executor
 	exit        sync.WaitGroup
+	closed      chan struct{}
+	closeOnce   sync.Once
 	values      sync.Map
 	readList    chan TInput
 	writeList   chan TOutput
@@ -89,6 +91,10 @@ func (this sessionInput[TInput, TOutput]) Alloc() relay.Buffer {
 	return this.session.bufferpool.New()
 }
 
+func (this sessionInput[TInput, TOutput]) Writer() codec.PipelineContext[Message] {
+	return this.session.writeCtx
+}
+
 func (this sessionOutput[TInput, TOutput]) Next(output Message) error {
 	return this.session.conn.WriteMessage(int(output.Type), output.Body)
 }
@@ -117,6 +123,7 @@ func (this *session[TInput, TOutput]) init() {
 	if !this.option.enable {
 		this.option = DefaultOption()
 	}
+	this.closed = make(chan struct{})
 	this.readList = make(chan TInput, this.option.maxReadPacket)
 	this.writeList = make(chan TOutput, this.option.maxWritePacket)
 	this.readCtx = sessionInput[TInput, TOutput]{session: this}
@@ -150,6 +157,7 @@ func (this *session[TInput, TOutput]) Start() error {
 
 func (this *session[TInput, TOutput]) Close() error {
 	if atomic.CompareAndSwapInt32(&this.runflag, 1, 2) {
+		this.shutdown()
 		this.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second*2))
 		return this.conn.Close()
 	}
@@ -190,11 +198,22 @@ func (this *session[TInput, TOutput]) message() {
 	}
 }
 
+func (this *session[TInput, TOutput]) shutdown() {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+}
+
 func (this *session[TInput, TOutput]) cleanup() {
 	this.exit.Wait()
 	atomic.StoreInt32(&this.runflag, 2)
 	this.loop.Execute(relay.ExecFunc(func() error {
 		err := this.handle.OnClose(this)
+		this.values.Range(func(key, value any) bool {
+			codec.Release(key, value)
+			this.values.Delete(key)
+			return true
+		})
 		go this.conn.Close()
 		return err
 	}))
@@ -203,7 +222,16 @@ func (this *session[TInput, TOutput]) cleanup() {
 func (this *session[TInput, TOutput]) write() {
 	defer this.exit.Done()
 	for {
-		output := <-this.writeList
+		var output TOutput
+		select {
+		case output = <-this.writeList:
+		case <-this.closed:
+			select {
+			case output = <-this.writeList:
+			default:
+				return
+			}
+		}
 		err := this.encoder(this.writeCtx, output)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok {
@@ -230,6 +258,10 @@ func (this *session[TInput, TOutput]) write() {
 func (this *session[TInput, TOutput]) read() {
 	defer this.exit.Done()
 	for {
+		if !relay.WaitBufferBudget(int64(this.option.bufferSize), this.closed) {
+			this.conn.SetWriteDeadline(time.Now())
+			break
+		}
 		keepAlive := false
 		if this.option.keepAlive > 0 {
 			keepAlive = true
@@ -241,6 +273,7 @@ func (this *session[TInput, TOutput]) read() {
 		}
 		if err != nil {
 			this.conn.SetWriteDeadline(time.Now())
+			this.shutdown()
 			break
 		}
 		err = this.decoder(this.readCtx, Message{MsgType(msgtype), bytes})
@@ -1,182 +1,358 @@
 package relay
 
 import (
-	"container/list"
 	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type Strategy int
+
+const (
+	StrategyFailover Strategy = iota
+	StrategyRoundRobin
+	StrategyRandom
+	StrategyLeastOutstanding
+	StrategyWeighted
+	StrategyConsistentHash
+)
+
+type ServiceStat struct {
+	ID          int
+	Weight      int
+	Healthy     bool
+	Outstanding int
+	Calls       uint64
+	Failures    uint64
+}
+
 type Service struct {
-	implements *list.List
-	last       *list.Element
+	core servicecore[func() error]
 }
 
 type ServiceArg[Arg any] struct {
-	implements *list.List
-	last       *list.Element
+	core servicecore[func(Arg) error]
 }
 
 type ServiceResult[Result any] struct {
-	implements *list.List
-	last       *list.Element
+	core servicecore[func() (Result, error)]
 }
 
 type ServiceArgResult[Arg, Result any] struct {
-	implements *list.List
-	last       *list.Element
+	core servicecore[func(Arg) (Result, error)]
+}
+
+func (this *Service) SetStrategy(strategy Strategy) *Service {
+	this.core.setstrategy(strategy)
+	return this
+}
+
+func (this *Service) SetCooldown(cooldown time.Duration, failures int) *Service {
+	this.core.setcooldown(cooldown, failures)
+	return this
 }
 
 func (this *Service) Register(implement func() error) func() {
-	if this.implements == nil {
-		this.implements = list.New()
-	}
-	element := this.implements.PushBack(implement)
-	return func() {
-		this.implements.Remove(element)
-	}
+	return this.core.register(implement, 1)
+}
+
+func (this *Service) RegisterWeighted(implement func() error, weight int) func() {
+	return this.core.register(implement, weight)
+}
+
+func (this *Service) Stats() []ServiceStat {
+	return this.core.stats()
 }
 
 func (this *Service) Call() error {
-	if this.implements == nil {
-		return NotImplement
-	}
-	start := this.last
-	if start == nil || start.Prev() == nil {
-		start = this.implements.Front()
-	}
-	err := NotImplement
-	element := start
-	for {
-		if element == nil {
-			element = this.implements.Front()
-		}
-		if element == start {
-			break
+	return this.core.call(nil, func(implement func() error) error {
+		return implement()
+	})
+}
+
+func (this *ServiceArg[Arg]) SetStrategy(strategy Strategy) *ServiceArg[Arg] {
+	this.core.setstrategy(strategy)
+	return this
+}
+
+func (this *ServiceArg[Arg]) SetCooldown(cooldown time.Duration, failures int) *ServiceArg[Arg] {
+	this.core.setcooldown(cooldown, failures)
+	return this
+}
+
+func (this *ServiceArg[Arg]) Register(implement func(Arg) error) func() {
+	return this.core.register(implement, 1)
+}
+
+func (this *ServiceArg[Arg]) RegisterWeighted(implement func(Arg) error, weight int) func() {
+	return this.core.register(implement, weight)
+}
+
+func (this *ServiceArg[Arg]) Stats() []ServiceStat {
+	return this.core.stats()
+}
+
+func (this *ServiceArg[Arg]) Call(arg Arg) error {
+	return this.core.call(arg, func(implement func(Arg) error) error {
+		return implement(arg)
+	})
+}
+
+func (this *ServiceResult[Result]) SetStrategy(strategy Strategy) *ServiceResult[Result] {
+	this.core.setstrategy(strategy)
+	return this
+}
+
+func (this *ServiceResult[Result]) SetCooldown(cooldown time.Duration, failures int) *ServiceResult[Result] {
+	this.core.setcooldown(cooldown, failures)
+	return this
+}
+
+func (this *ServiceResult[Result]) Register(implement func() (Result, error)) func() {
+	return this.core.register(implement, 1)
+}
+
+func (this *ServiceResult[Result]) RegisterWeighted(implement func() (Result, error), weight int) func() {
+	return this.core.register(implement, weight)
+}
+
+func (this *ServiceResult[Result]) Stats() []ServiceStat {
+	return this.core.stats()
+}
+
+func (this *ServiceResult[Result]) Call() (Result, error) {
+	var result Result
+	err := this.core.call(nil, func(implement func() (Result, error)) error {
+		value, err := implement()
+		if err == nil {
+			result = value
 		}
-		implement := element.Value.(func() error)
-		err = implement()
+		return err
+	})
+	return result, err
+}
+
+func (this *ServiceArgResult[Arg, Result]) SetStrategy(strategy Strategy) *ServiceArgResult[Arg, Result] {
+	this.core.setstrategy(strategy)
+	return this
+}
+
+func (this *ServiceArgResult[Arg, Result]) SetCooldown(cooldown time.Duration, failures int) *ServiceArgResult[Arg, Result] {
+	this.core.setcooldown(cooldown, failures)
+	return this
+}
+
+func (this *ServiceArgResult[Arg, Result]) Register(implement func(Arg) (Result, error)) func() {
+	return this.core.register(implement, 1)
+}
+
+func (this *ServiceArgResult[Arg, Result]) RegisterWeighted(implement func(Arg) (Result, error), weight int) func() {
+	return this.core.register(implement, weight)
+}
+
+func (this *ServiceArgResult[Arg, Result]) Stats() []ServiceStat {
+	return this.core.stats()
+}
+
+func (this *ServiceArgResult[Arg, Result]) Call(arg Arg) (Result, error) {
+	var result Result
+	err := this.core.call(arg, func(implement func(Arg) (Result, error)) error {
+		value, err := implement(arg)
 		if err == nil {
-			this.last = element
-			return nil
+			result = value
 		}
-		element = element.Next()
-	}
-	return err
+		return err
+	})
+	return result, err
 }
 
-func (this *ServiceArg[Arg]) Register(implement func(Arg) error) func() {
-	if this.implements == nil {
-		this.implements = list.New()
+var NotImplement = errors.New("not implement")
+
+type servicecore[F any] struct {
+	guard     sync.Mutex
+	implement []*serviceimpl[F]
+	strategy  Strategy
+	cooldown  time.Duration
+	failures  int
+	seq       int
+	next      uint64
+	last      int
+}
+
+type serviceimpl[F any] struct {
+	id          int
+	implement   F
+	weight      int
+	current     int
+	outstanding int32
+	calls       uint64
+	failures    uint64
+	consecutive int
+	unhealthy   time.Time
+}
+
+func (this *servicecore[F]) setstrategy(strategy Strategy) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	this.strategy = strategy
+}
+
+func (this *servicecore[F]) setcooldown(cooldown time.Duration, failures int) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	this.cooldown = cooldown
+	this.failures = failures
+}
+
+func (this *servicecore[F]) register(implement F, weight int) func() {
+	if weight <= 0 {
+		weight = 1
 	}
-	element := this.implements.PushBack(implement)
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	this.seq++
+	impl := &serviceimpl[F]{id: this.seq, implement: implement, weight: weight}
+	this.implement = append(this.implement[:len(this.implement):len(this.implement)], impl)
 	return func() {
-		this.implements.Remove(element)
+		this.guard.Lock()
+		defer this.guard.Unlock()
+		for i, element := range this.implement {
+			if element == impl {
+				this.implement = append(this.implement[:i:i], this.implement[i+1:]...)
+				break
+			}
+		}
 	}
 }
 
-func (this *ServiceArg[Arg]) Call(arg Arg) error {
-	if this.implements == nil {
-		return NotImplement
+func (this *servicecore[F]) stats() []ServiceStat {
+	now := Now()
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	result := make([]ServiceStat, len(this.implement))
+	for i, impl := range this.implement {
+		result[i] = ServiceStat{
+			ID:          impl.id,
+			Weight:      impl.weight,
+			Healthy:     !now.Before(impl.unhealthy),
+			Outstanding: int(atomic.LoadInt32(&impl.outstanding)),
+			Calls:       impl.calls,
+			Failures:    impl.failures,
+		}
 	}
-	start := this.last
-	if start == nil || start.Prev() == nil {
-		start = this.implements.Front()
+	return result
+}
+
+func (this *servicecore[F]) call(key any, invoke func(F) error) error {
+	candidates := this.pick(key)
+	if len(candidates) == 0 {
+		return NotImplement
 	}
-	err := NotImplement
-	element := start
-	for {
-		if element == nil {
-			element = this.implements.Front()
-		}
-		if element == start {
-			break
-		}
-		implement := element.Value.(func(Arg) error)
-		err = implement(arg)
+	var err error
+	for _, impl := range candidates {
+		atomic.AddInt32(&impl.outstanding, 1)
+		err = invoke(impl.implement)
+		atomic.AddInt32(&impl.outstanding, -1)
+		this.report(impl, err)
 		if err == nil {
-			this.last = element
 			return nil
 		}
-		element = element.Next()
 	}
 	return err
 }
 
-func (this *ServiceResult[Result]) Register(implement func() (Result, error)) func() {
-	if this.implements == nil {
-		this.implements = list.New()
-	}
-	element := this.implements.PushBack(implement)
-	return func() {
-		this.implements.Remove(element)
-	}
-}
-
-func (this *ServiceResult[Result]) Call() (Result, error) {
-	var result Result
-	if this.implements == nil {
-		return result, NotImplement
+func (this *servicecore[F]) pick(key any) []*serviceimpl[F] {
+	now := Now()
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	healthy := make([]*serviceimpl[F], 0, len(this.implement))
+	var unhealthy []*serviceimpl[F]
+	for _, impl := range this.implement {
+		if now.Before(impl.unhealthy) {
+			unhealthy = append(unhealthy, impl)
+		} else {
+			healthy = append(healthy, impl)
+		}
 	}
-	start := this.last
-	if start == nil || start.Prev() == nil {
-		start = this.implements.Front()
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		return unhealthy[i].unhealthy.Before(unhealthy[j].unhealthy)
+	})
+	if len(healthy) == 0 {
+		return unhealthy
 	}
-	err := NotImplement
-	element := start
-	for {
-		if element == nil {
-			element = this.implements.Front()
+	switch this.strategy {
+	case StrategyRoundRobin:
+		this.next++
+		healthy = rotate(healthy, int(this.next%uint64(len(healthy))))
+	case StrategyRandom:
+		healthy = rotate(healthy, rand.Intn(len(healthy)))
+	case StrategyLeastOutstanding:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return atomic.LoadInt32(&healthy[i].outstanding) < atomic.LoadInt32(&healthy[j].outstanding)
+		})
+	case StrategyWeighted:
+		total := 0
+		best := 0
+		for i, impl := range healthy {
+			impl.current += impl.weight
+			total += impl.weight
+			if impl.current > healthy[best].current {
+				best = i
+			}
 		}
-		if element == start {
-			break
+		healthy[best].current -= total
+		healthy = rotate(healthy, best)
+	case StrategyConsistentHash:
+		if key != nil {
+			hash := hashkey(key)
+			sort.SliceStable(healthy, func(i, j int) bool {
+				return mixhash(hash^uint64(healthy[i].id)) > mixhash(hash^uint64(healthy[j].id))
+			})
 		}
-		implement := element.Value.(func() (Result, error))
-		result, err = implement()
-		if err == nil {
-			this.last = element
-			return result, nil
+	default:
+		for i, impl := range healthy {
+			if impl.id == this.last {
+				healthy = rotate(healthy, i)
+				break
+			}
 		}
-		element = element.Next()
 	}
-	return result, err
+	return append(healthy, unhealthy...)
 }
 
-func (this *ServiceArgResult[Arg, Result]) Register(implement func(Arg) (Result, error)) func() {
-	if this.implements == nil {
-		this.implements = list.New()
+func (this *servicecore[F]) report(impl *serviceimpl[F], err error) {
+	now := Now()
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	impl.calls++
+	if err == nil {
+		impl.consecutive = 0
+		impl.unhealthy = time.Time{}
+		this.last = impl.id
+		return
 	}
-	element := this.implements.PushBack(implement)
-	return func() {
-		this.implements.Remove(element)
+	impl.failures++
+	impl.consecutive++
+	if this.cooldown <= 0 {
+		return
 	}
-}
-
-func (this *ServiceArgResult[Arg, Result]) Call(arg Arg) (Result, error) {
-	var result Result
-	if this.implements == nil {
-		return result, NotImplement
-	}
-	start := this.last
-	if start == nil || start.Prev() == nil {
-		start = this.implements.Front()
+	failures := this.failures
+	if failures <= 0 {
+		failures = 1
 	}
-	err := NotImplement
-	element := start
-	for {
-		if element == nil {
-			element = this.implements.Front()
-		}
-		if element == start {
-			break
-		}
-		implement := element.Value.(func(Arg) (Result, error))
-		result, err = implement(arg)
-		if err == nil {
-			this.last = element
-			return result, nil
-		}
-		element = element.Next()
+	if impl.consecutive >= failures {
+		impl.unhealthy = now.Add(this.cooldown)
 	}
-	return result, err
 }
 
-var NotImplement = errors.New("not implement")
+func rotate[T any](list []T, start int) []T {
+	if start == 0 {
+		return list
+	}
+	result := make([]T, 0, len(list))
+	result = append(result, list[start:]...)
+	return append(result, list[:start]...)
+}
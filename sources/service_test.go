@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestServiceStrategies(t *testing.T) {
+	var service ServiceResult[string]
+	service.SetStrategy(StrategyRoundRobin)
+	service.Register(func() (string, error) {
+		return "a", nil
+	})
+	service.Register(func() (string, error) {
+		return "b", nil
+	})
+	var results []string
+	for i := 0; i < 4; i++ {
+		result, err := service.Call()
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	if expect := []string{"b", "a", "b", "a"}; !reflect.DeepEqual(results, expect) {
+		t.Fatalf("expect %v, got %v", expect, results)
+	}
+
+	var weighted ServiceResult[string]
+	weighted.SetStrategy(StrategyWeighted)
+	weighted.RegisterWeighted(func() (string, error) {
+		return "heavy", nil
+	}, 3)
+	weighted.RegisterWeighted(func() (string, error) {
+		return "light", nil
+	}, 1)
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		result, _ := weighted.Call()
+		counts[result]++
+	}
+	if counts["heavy"] != 6 || counts["light"] != 2 {
+		t.Fatalf("unexpected weighted distribution %v", counts)
+	}
+
+	var hashed ServiceArgResult[string, int]
+	hashed.SetStrategy(StrategyConsistentHash)
+	for i := 0; i < 4; i++ {
+		id := i
+		hashed.Register(func(key string) (int, error) {
+			return id, nil
+		})
+	}
+	for _, key := range []string{"alice", "bob", "carol"} {
+		first, _ := hashed.Call(key)
+		for i := 0; i < 3; i++ {
+			if next, _ := hashed.Call(key); next != first {
+				t.Fatalf("expect key %s to stick to %d, got %d", key, first, next)
+			}
+		}
+	}
+}
+
+func TestServiceHealth(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	results := make(chan []string, 1)
+	var service ServiceArg[string]
+	broken := true
+	loop.Execute(ExecFunc(func() error {
+		service.SetCooldown(time.Second*10, 1)
+		service.Register(func(caller string) error {
+			if broken {
+				return errors.New("broken")
+			}
+			return nil
+		})
+		service.Register(func(caller string) error {
+			return nil
+		})
+		return nil
+	}))
+	loop.Execute(ExecFunc(func() error {
+		var calls []string
+		if err := service.Call("x"); err != nil {
+			return err
+		}
+		for _, stat := range service.Stats() {
+			calls = append(calls, fmt.Sprintf("%d:%t:%d/%d", stat.ID, stat.Healthy, stat.Failures, stat.Calls))
+		}
+		results <- calls
+		return nil
+	}))
+	if expect := []string{"1:false:1/1", "2:true:0/1"}; !reflect.DeepEqual(<-results, expect) {
+		t.Fatalf("unexpected stats")
+	}
+	loop.Advance(time.Second * 11)
+	loop.Execute(ExecFunc(func() error {
+		broken = false
+		var calls []string
+		if err := service.Call("x"); err != nil {
+			return err
+		}
+		for _, stat := range service.Stats() {
+			calls = append(calls, fmt.Sprintf("%d:%t:%d/%d", stat.ID, stat.Healthy, stat.Failures, stat.Calls))
+		}
+		results <- calls
+		return nil
+	}))
+	if result, expect := <-results, []string{"1:true:1/1", "2:true:0/2"}; !reflect.DeepEqual(result, expect) {
+		t.Fatalf("expect %v, got %v", expect, result)
+	}
+}
+
+func TestServiceNoDefaultCooldown(t *testing.T) {
+	loop := StartSimLoop(time.Unix(0, 0))
+	defer loop.Cancel()
+	results := make(chan []string, 1)
+	var service ServiceArg[string]
+	loop.Execute(ExecFunc(func() error {
+		service.Register(func(caller string) error {
+			return errors.New("broken")
+		})
+		service.Register(func(caller string) error {
+			return nil
+		})
+		service.Call("x")
+		var calls []string
+		for _, stat := range service.Stats() {
+			calls = append(calls, fmt.Sprintf("%d:%t", stat.ID, stat.Healthy))
+		}
+		results <- calls
+		return nil
+	}))
+	if result, expect := <-results, []string{"1:true", "2:true"}; !reflect.DeepEqual(result, expect) {
+		t.Fatalf("expect %v, got %v", expect, result)
+	}
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type SimLoop interface {
+	Loop
+	LoopInspector
+	Clock
+	Advance(d time.Duration)
+	AdvanceTo(target time.Time)
+	Flush()
+}
+
+func StartSimLoop(start time.Time) SimLoop {
+	return StartSimLoopWith(start, DefaultLoopOptions())
+}
+
+func StartSimLoopWith(start time.Time, options LoopOptions) SimLoop {
+	timers := &simtimers{current: start}
+	heap.Init(&timers.list)
+	return &simloop{loop: startloop(options, timers), timers: timers}
+}
+
+type simloop struct {
+	*loop
+	timers *simtimers
+}
+
+type simtimers struct {
+	guard   sync.Mutex
+	current time.Time
+	list    timerlist
+}
+
+func (this *simloop) Now() time.Time {
+	return this.timers.now()
+}
+
+func (this *simloop) Advance(d time.Duration) {
+	this.AdvanceTo(this.Now().Add(d))
+}
+
+func (this *simloop) AdvanceTo(target time.Time) {
+	if currentloop() == this.loop {
+		panic(errors.New("can not advance a SimLoop from inside itself"))
+	}
+	for {
+		this.Flush()
+		if this.Err() != nil {
+			return
+		}
+		if !this.timers.fire(target) {
+			break
+		}
+	}
+	this.timers.guard.Lock()
+	if this.timers.current.Before(target) {
+		this.timers.current = target
+	}
+	this.timers.guard.Unlock()
+	this.Flush()
+}
+
+func (this *simloop) Flush() {
+	this.list.waitidle()
+}
+
+func (this *simtimers) now() time.Time {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	return this.current
+}
+
+func (this *simtimers) start(timer *timer) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if timer.index == -1 {
+		heap.Push(&this.list, timer)
+	}
+}
+
+func (this *simtimers) stop(timer *timer) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if timer.index != -1 {
+		heap.Remove(&this.list, timer.index)
+	}
+}
+
+func (this *simtimers) fire(target time.Time) bool {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if this.list.length == 0 {
+		return false
+	}
+	timer := this.list.timers[0]
+	if timer.next.After(target) {
+		return false
+	}
+	heap.Pop(&this.list)
+	if timer.next.After(this.current) {
+		this.current = timer.next
+	}
+	if timer.fire(this.current) {
+		heap.Push(&this.list, timer)
+	}
+	return true
+}
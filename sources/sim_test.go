@@ -0,0 +1,164 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSimLoopTimers(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var fired []string
+	loop.Execute(ExecFunc(func() error {
+		After(time.Second*3, func() error {
+			fired = append(fired, "after:"+Now().Sub(start).String())
+			return nil
+		})
+		timer := NewTimer(TimeoutFunc(func(timer Timer) error {
+			fired = append(fired, "interval:"+Now().Sub(start).String())
+			return nil
+		}))
+		timer.StartNow(WithInterval(time.Second * 2))
+		return nil
+	}))
+	loop.Advance(time.Second * 5)
+	expect := []string{"interval:2s", "after:3s", "interval:4s"}
+	if !reflect.DeepEqual(fired, expect) {
+		t.Fatalf("expect %v, got %v", expect, fired)
+	}
+	if !loop.Now().Equal(start.Add(time.Second * 5)) {
+		t.Fatalf("expect now %v, got %v", start.Add(time.Second*5), loop.Now())
+	}
+}
+
+func TestSimLoopSchedule(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	count := 0
+	loop.Execute(ExecFunc(func() error {
+		_, err := Schedule(Now(), "0 4 * * *", func() error {
+			count++
+			if Now().Hour() != 4 {
+				t.Errorf("expect fire at 04:00, got %v", Now())
+			}
+			return nil
+		})
+		return err
+	}))
+	loop.Advance(time.Hour * 24 * 7)
+	if count != 7 {
+		t.Fatalf("expect 7 runs, got %d", count)
+	}
+}
+
+func TestSimLoopStop(t *testing.T) {
+	loop := StartSimLoop(time.Unix(0, 0))
+	defer loop.Cancel()
+	count := 0
+	var stop func()
+	loop.Execute(ExecFunc(func() error {
+		stop = After(time.Second, func() error {
+			count++
+			return nil
+		})
+		return nil
+	}))
+	loop.Flush()
+	loop.Execute(ExecFunc(func() error {
+		stop()
+		return nil
+	}))
+	loop.Advance(time.Second * 2)
+	if count != 0 {
+		t.Fatalf("expect stopped timer not to fire, fired %d", count)
+	}
+}
+
+func TestSimLoopNamedTimer(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var timer NamedTimer
+	loop.Execute(ExecFunc(func() error {
+		timer = NewNamedTimer("reset", TimeoutFunc(func(timer Timer) error {
+			return nil
+		}))
+		timer.StartNow(WithInterval(time.Minute))
+		return nil
+	}))
+	loop.Advance(time.Second * 90)
+	if next, ok := timer.Next(); !ok || !next.Equal(start.Add(time.Minute*2)) {
+		t.Fatalf("expect next %v, got %v", start.Add(time.Minute*2), next)
+	}
+	if timer.Remaining() != time.Second*30 {
+		t.Fatalf("expect remaining 30s, got %v", timer.Remaining())
+	}
+	timer.Reset(WithDelay(time.Second))
+	loop.Flush()
+	infos := loop.Timers()
+	if len(infos) != 1 || infos[0].Name != "reset" || infos[0].Remaining != time.Second {
+		t.Fatalf("unexpected timers %v", infos)
+	}
+	loop.Advance(time.Second)
+	if next, ok := timer.Next(); timer.Running() || ok {
+		t.Fatalf("expect timer stopped, next %v", next)
+	}
+	timer.Close()
+	loop.Flush()
+	if infos := loop.Timers(); len(infos) != 0 {
+		t.Fatalf("expect closed timer unregistered, got %v", infos)
+	}
+}
+
+func TestSimLoopTimerAtEpoch(t *testing.T) {
+	start := time.Unix(0, 0).Add(-time.Second)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var timer NamedTimer
+	loop.Execute(ExecFunc(func() error {
+		timer = NewNamedTimer("epoch", TimeoutFunc(func(timer Timer) error {
+			return nil
+		}))
+		timer.StartNow(WithDelay(time.Second))
+		return nil
+	}))
+	loop.Flush()
+	if next, ok := timer.Next(); !ok || !next.Equal(time.Unix(0, 0)) {
+		t.Fatalf("expect next at epoch, got %v %t", next, ok)
+	}
+}
+
+func TestSimLoopFlushWaitsForAwait(t *testing.T) {
+	loop := StartSimLoop(time.Unix(0, 0))
+	defer loop.Cancel()
+	var steps []string
+	loop.Execute(ExecFunc(func() error {
+		ch := make(chan int)
+		go func() {
+			time.Sleep(time.Millisecond * 20)
+			ch <- 1
+		}()
+		Poll(ch)
+		steps = append(steps, "poll")
+		Await(func() {
+			time.Sleep(time.Millisecond * 20)
+		})
+		steps = append(steps, "await")
+		NewTimer(TimeoutFunc(func(timer Timer) error {
+			steps = append(steps, "timer")
+			return nil
+		})).StartNow(WithDelay(time.Second))
+		return nil
+	}))
+	loop.Flush()
+	if len(steps) != 2 || steps[1] != "await" {
+		t.Fatalf("expect Flush to wait for Poll and Await, got %v", steps)
+	}
+	loop.Advance(time.Second)
+	if len(steps) != 3 {
+		t.Fatalf("expect timer fired, got %v", steps)
+	}
+}
@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Debouncer struct {
+	loop    Loop
+	timer   Timer
+	wait    time.Duration
+	maxWait time.Duration
+	first   time.Time
+	pending bool
+	action  func() error
+}
+
+type Throttler struct {
+	loop     Loop
+	timer    Timer
+	interval time.Duration
+	last     time.Time
+	pending  bool
+	action   func() error
+}
+
+type RateLimiter struct {
+	loop   Loop
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewDebouncer(wait time.Duration, action func() error) *Debouncer {
+	result := &Debouncer{loop: InLoop(), wait: wait, action: action}
+	result.timer = NewTimer(TimeoutFunc(func(timer Timer) error {
+		return result.Flush()
+	}))
+	return result
+}
+
+func (this *Debouncer) SetMaxWait(maxWait time.Duration) *Debouncer {
+	this.maxWait = maxWait
+	return this
+}
+
+func (this *Debouncer) Trigger() {
+	owned(this.loop)
+	now := Now()
+	if !this.pending {
+		this.pending = true
+		this.first = now
+	}
+	next := now.Add(this.wait)
+	if this.maxWait > 0 && next.After(this.first.Add(this.maxWait)) {
+		next = this.first.Add(this.maxWait)
+	}
+	this.timer.StartNow(WithDelay(next.Sub(now)))
+}
+
+func (this *Debouncer) Pending() bool {
+	owned(this.loop)
+	return this.pending
+}
+
+func (this *Debouncer) Flush() error {
+	owned(this.loop)
+	if !this.pending {
+		return nil
+	}
+	this.pending = false
+	this.timer.Stop()
+	return this.action()
+}
+
+func (this *Debouncer) Cancel() {
+	owned(this.loop)
+	this.pending = false
+	this.timer.Stop()
+}
+
+func NewThrottler(interval time.Duration, action func() error) *Throttler {
+	result := &Throttler{loop: InLoop(), interval: interval, action: action}
+	result.timer = NewTimer(TimeoutFunc(func(timer Timer) error {
+		if !result.pending {
+			return nil
+		}
+		result.pending = false
+		result.last = Now()
+		return result.action()
+	}))
+	return result
+}
+
+func (this *Throttler) Trigger() error {
+	owned(this.loop)
+	now := Now()
+	next := this.last.Add(this.interval)
+	if this.last.IsZero() || !now.Before(next) {
+		this.last = now
+		return this.action()
+	}
+	if !this.pending {
+		this.pending = true
+		this.timer.StartNow(WithDelay(next.Sub(now)))
+	}
+	return nil
+}
+
+func (this *Throttler) Pending() bool {
+	owned(this.loop)
+	return this.pending
+}
+
+func (this *Throttler) Cancel() {
+	owned(this.loop)
+	this.pending = false
+	this.timer.Stop()
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{loop: InLoop(), rate: rate, burst: float64(burst), tokens: float64(burst), last: Now()}
+}
+
+func (this *RateLimiter) Tokens() float64 {
+	owned(this.loop)
+	this.refill(Now())
+	return this.tokens
+}
+
+func (this *RateLimiter) Allow() bool {
+	return this.AllowN(1)
+}
+
+func (this *RateLimiter) AllowN(n int) bool {
+	owned(this.loop)
+	this.refill(Now())
+	if this.tokens < float64(n) {
+		return false
+	}
+	this.tokens -= float64(n)
+	return true
+}
+
+func (this *RateLimiter) Wait() error {
+	return this.WaitN(1)
+}
+
+func (this *RateLimiter) WaitN(n int) error {
+	owned(this.loop)
+	if float64(n) > this.burst {
+		return errors.Errorf("rate limiter wait %d exceeds burst %v", n, this.burst)
+	}
+	for !this.AllowN(n) {
+		if this.rate <= 0 {
+			return errors.New("rate limiter has zero rate")
+		}
+		lack := float64(n) - this.tokens
+		if err := Sleep(time.Duration(lack / this.rate * float64(time.Second))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(this.last)
+	if elapsed <= 0 {
+		return
+	}
+	this.last = now
+	this.tokens += elapsed.Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+}
+
+func owned(loop Loop) {
+	if IsInLoop() != loop {
+		panic(errors.New("can only be called in the owning Loop"))
+	}
+}
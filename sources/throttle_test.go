@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var saves []time.Duration
+	var debouncer *Debouncer
+	loop.Execute(ExecFunc(func() error {
+		debouncer = NewDebouncer(time.Second*5, func() error {
+			saves = append(saves, Now().Sub(start))
+			return nil
+		}).SetMaxWait(time.Second * 12)
+		return nil
+	}))
+	trigger := func() {
+		loop.Execute(ExecFunc(func() error {
+			debouncer.Trigger()
+			return nil
+		}))
+	}
+	for i := 0; i < 5; i++ {
+		trigger()
+		loop.Advance(time.Second * 2)
+	}
+	loop.Advance(time.Second * 10)
+	trigger()
+	loop.Advance(time.Second * 3)
+	trigger()
+	loop.Advance(time.Second * 10)
+	expect := []time.Duration{time.Second * 12, time.Second * 28}
+	if !reflect.DeepEqual(saves, expect) {
+		t.Fatalf("expect %v, got %v", expect, saves)
+	}
+}
+
+func TestThrottler(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var runs []time.Duration
+	var throttler *Throttler
+	loop.Execute(ExecFunc(func() error {
+		throttler = NewThrottler(time.Second*5, func() error {
+			runs = append(runs, Now().Sub(start))
+			return nil
+		})
+		return nil
+	}))
+	for i := 0; i < 8; i++ {
+		loop.Execute(ExecFunc(func() error {
+			return throttler.Trigger()
+		}))
+		loop.Advance(time.Second)
+	}
+	loop.Advance(time.Second * 10)
+	expect := []time.Duration{0, time.Second * 5, time.Second * 10}
+	if !reflect.DeepEqual(runs, expect) {
+		t.Fatalf("expect %v, got %v", expect, runs)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(0, 0)
+	loop := StartSimLoop(start)
+	defer loop.Cancel()
+	var limiter *RateLimiter
+	var allowed []bool
+	loop.Execute(ExecFunc(func() error {
+		limiter = NewRateLimiter(2, 3)
+		for i := 0; i < 4; i++ {
+			allowed = append(allowed, limiter.Allow())
+		}
+		return nil
+	}))
+	loop.Advance(time.Millisecond * 500)
+	var waited []time.Duration
+	loop.Execute(ExecFunc(func() error {
+		allowed = append(allowed, limiter.Allow(), limiter.Allow())
+		for i := 0; i < 2; i++ {
+			if err := limiter.Wait(); err != nil {
+				return err
+			}
+			waited = append(waited, Now().Sub(start))
+		}
+		return nil
+	}))
+	loop.Advance(time.Second * 5)
+	if expect := []bool{true, true, true, false, true, false}; !reflect.DeepEqual(allowed, expect) {
+		t.Fatalf("expect %v, got %v", expect, allowed)
+	}
+	if expect := []time.Duration{time.Second, time.Millisecond * 1500}; !reflect.DeepEqual(waited, expect) {
+		t.Fatalf("expect %v, got %v", expect, waited)
+	}
+}
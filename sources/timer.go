@@ -1,12 +1,9 @@
 package relay
 
 import (
-	"container/heap"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/robfig/cron/v3"
 )
 
 type Timeout interface {
@@ -26,10 +23,32 @@ type Timer interface {
 	Stop()
 }
 
+type NamedTimer interface {
+	Timer
+	Name() string
+	Next() (time.Time, bool)
+	Planned() time.Time
+	Remaining() time.Duration
+	Reset(interval TimerSchedule)
+	Close()
+}
+
+type TimerInfo struct {
+	Name      string
+	Running   bool
+	Next      time.Time
+	Remaining time.Duration
+}
+
 type TimerSchedule interface {
 	Next(time.Time) time.Time
 }
 
+type PlannedSchedule interface {
+	TimerSchedule
+	Plan(last, now time.Time) (planned, next time.Time)
+}
+
 func NewTimer(timeout Timeout) Timer {
 	loop := InLoop()
 	result := &timer{
@@ -43,6 +62,18 @@ func NewTimer(timeout Timeout) Timer {
 	return result
 }
 
+func NewNamedTimer(name string, timeout Timeout) NamedTimer {
+	result := NewTimer(timeout).(*timer)
+	result.name = name
+	names := &result.loop.(*loop).timernames
+	previous, ok := names.LoadOrStore(name, result)
+	if ok {
+		names.Store(name, result)
+		previous.(*timer).Stop()
+	}
+	return result
+}
+
 func Schedule(now time.Time, cron string, action func() error) (func(), error) {
 	schedule, err := WithCron(cron)
 	if err != nil {
@@ -91,77 +122,139 @@ func WithDelayAndInterval(delay time.Duration, interval time.Duration) TimerSche
 	}
 }
 
-func WithCron(cron string) (TimerSchedule, error) {
-	return cronparser.Parse(cron)
+type Clock interface {
+	Now() time.Time
 }
 
 type timer struct {
 	loop     Loop
+	name     string
 	schedule TimerSchedule
 	next     time.Time
+	last     time.Time
+	fired    time.Time
+	planned  atomic.Value
 	running  int32
 	index    int
+	seq      uint64
+	bucket   *timerbucket
+	level    int
+	before   *timer
+	after    *timer
 	executor Executor
 }
 
+type timerdriver interface {
+	now() time.Time
+	start(timer *timer)
+	stop(timer *timer)
+}
+
+func Now() time.Time {
+	if loop := currentloop(); loop != nil {
+		return loop.timers.now()
+	}
+	return time.Now()
+}
+
+func (this *timer) Name() string {
+	return this.name
+}
+
 func (this *timer) Running() bool {
 	return atomic.LoadInt32(&this.running) != 0
 }
 
+func (this *timer) Next() (time.Time, bool) {
+	planned, ok := this.planned.Load().(time.Time)
+	if !ok || planned.IsZero() || !this.Running() {
+		return time.Time{}, false
+	}
+	return planned, true
+}
+
+func (this *timer) Planned() time.Time {
+	return this.fired
+}
+
+func (this *timer) Remaining() time.Duration {
+	next, ok := this.Next()
+	if !ok {
+		return 0
+	}
+	remaining := next.Sub(this.loop.(*loop).timers.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (this *timer) Reset(schedule TimerSchedule) {
+	if IsInLoop() == this.loop {
+		this.StartNow(schedule)
+	} else {
+		this.loop.(*loop).ExecuteUrgent(ExecFunc(func() error {
+			this.StartNow(schedule)
+			return nil
+		}))
+	}
+}
+
+func (this *timer) Close() {
+	if IsInLoop() == this.loop {
+		this.Stop()
+		names := &this.loop.(*loop).timernames
+		if current, ok := names.Load(this.name); ok && current == this {
+			names.Delete(this.name)
+		}
+	} else {
+		this.loop.(*loop).ExecuteUrgent(ExecFunc(func() error {
+			this.Close()
+			return nil
+		}))
+	}
+}
+
+func (this *timer) info() TimerInfo {
+	next, _ := this.Next()
+	return TimerInfo{
+		Name:      this.name,
+		Running:   this.Running(),
+		Next:      next,
+		Remaining: this.Remaining(),
+	}
+}
+
+func (this *timer) schedulenext(now time.Time) {
+	if schedule, ok := this.schedule.(PlannedSchedule); ok {
+		this.last, this.next = schedule.Plan(this.last, now)
+	} else {
+		this.next = this.schedule.Next(now)
+	}
+	this.planned.Store(this.next)
+}
+
 func (this *timer) StartNow(schedule TimerSchedule) {
-	this.Start(time.Now(), schedule)
+	this.Start(this.loop.(*loop).timers.now(), schedule)
 }
 
 func (this *timer) Start(now time.Time, schedule TimerSchedule) {
 	if IsInLoop() == this.loop {
-		timeronce.Do(func() {
-			heap.Init(&timers)
-			go func() {
-				for {
-					var now time.Time
-					select {
-					case modify := <-timers.modify:
-						if modify.start {
-							if modify.timer.index == -1 {
-								heap.Push(&timers, modify.timer)
-							}
-						} else {
-							if modify.timer.index != -1 {
-								heap.Remove(&timers, modify.timer.index)
-							}
-						}
-						now = time.Now()
-					case now = <-timers.timer.C:
-						for timers.length != 0 {
-							timer := timers.timers[0]
-							if timer.next.After(now) {
-								break
-							}
-							heap.Pop(&timers)
-							timer.next = timer.schedule.Next(now)
-							if !timer.next.IsZero() {
-								heap.Push(&timers, timer)
-							} else {
-								atomic.StoreInt32(&timer.running, 0)
-							}
-							timer.loop.Execute(timer.executor)
-						}
-					}
-					interval := time.Hour * 24
-					if len(timers.timers) != 0 {
-						interval = timers.timers[0].next.Sub(now)
-					}
-					timers.timer.Reset(interval)
-				}
-			}()
-		})
+		timers := this.loop.(*loop).timers
+		if !atomic.CompareAndSwapInt32(&this.running, 0, 1) {
+			timers.stop(this)
+		}
 		this.schedule = schedule
-		this.next = this.schedule.Next(now)
-		if atomic.CompareAndSwapInt32(&this.running, 0, 1) {
-			timers.modify <- timermodify{true, this}
+		this.last = time.Time{}
+		this.schedulenext(now)
+		if this.next.IsZero() {
+			atomic.StoreInt32(&this.running, 0)
+			return
 		}
+		this.seq = atomic.AddUint64(&timerseq, 1)
+		timers.start(this)
 	} else {
-		this.loop.Execute(ExecFunc(func() error {
+		this.loop.(*loop).ExecuteUrgent(ExecFunc(func() error {
 			this.Start(now, schedule)
 			return nil
 		}))
@@ -171,16 +264,29 @@ func (this *timer) Start(now time.Time, schedule TimerSchedule) {
 func (this *timer) Stop() {
 	if IsInLoop() == this.loop {
 		if atomic.CompareAndSwapInt32(&this.running, 1, 0) {
-			timers.modify <- timermodify{false, this}
+			this.loop.(*loop).timers.stop(this)
 		}
 	} else {
-		this.loop.Execute(ExecFunc(func() error {
+		this.loop.(*loop).ExecuteUrgent(ExecFunc(func() error {
 			this.Stop()
 			return nil
 		}))
 	}
 }
 
+func (this *timer) fire(now time.Time) bool {
+	this.fired = this.last
+	if this.fired.IsZero() {
+		this.fired = this.next
+	}
+	this.schedulenext(now)
+	if this.next.IsZero() {
+		atomic.StoreInt32(&this.running, 0)
+	}
+	this.loop.(*loop).ExecuteUrgent(this.executor)
+	return !this.next.IsZero()
+}
+
 type reusable struct {
 	timer
 	action func() error
@@ -188,35 +294,29 @@ type reusable struct {
 }
 
 type linear struct {
-	last     *time.Time
 	delay    time.Duration
 	interval time.Duration
 }
 
 func (this *linear) Next(now time.Time) time.Time {
-	if this.last == nil {
-		result := now.Add(this.delay)
-		this.last = &result
-	} else if this.interval > 0 {
-		result := this.last.Add(this.interval)
-		this.last = &result
-	} else {
-		result := time.Time{}
-		this.last = &result
-	}
-	return *this.last
+	return now.Add(this.delay)
 }
 
-type timermodify struct {
-	start bool
-	timer *timer
+func (this *linear) Plan(last, now time.Time) (time.Time, time.Time) {
+	if last.IsZero() {
+		next := now.Add(this.delay)
+		return next, next
+	}
+	if this.interval > 0 {
+		next := last.Add(this.interval)
+		return next, next
+	}
+	return time.Time{}, time.Time{}
 }
 
 type timerlist struct {
 	timers []*timer
-	timer  *time.Timer
 	length int
-	modify chan timermodify
 }
 
 func (this *timerlist) Len() int {
@@ -224,7 +324,11 @@ func (this *timerlist) Len() int {
 }
 
 func (this *timerlist) Less(i, j int) bool {
-	return this.timers[i].next.Before(this.timers[j].next)
+	left, right := this.timers[i], this.timers[j]
+	if left.next.Equal(right.next) {
+		return left.seq < right.seq
+	}
+	return left.next.Before(right.next)
 }
 
 func (this *timerlist) Swap(i, j int) {
@@ -257,17 +361,13 @@ func (this *timerlist) Pop() any {
 	}
 	index := this.length - 1
 	result := this.timers[index]
+	this.timers[index] = nil
 	result.index = -1
 	this.length--
 	return result
 }
 
-var timers = timerlist{
-	timer:  time.NewTimer(time.Hour * 24),
-	modify: make(chan timermodify),
-}
-var timeronce sync.Once
-var cronparser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+var timerseq uint64
 var reusablelist = sync.Pool{}
 
 func reusableNew() *reusable {
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"container/heap"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+const benchmarkTimers = 10000
+
+func benchmarkTimerList(count int) []*timer {
+	base := time.Unix(0, 0)
+	random := rand.New(rand.NewSource(1))
+	timers := make([]*timer, count)
+	for i := range timers {
+		timers[i] = &timer{next: base.Add(time.Duration(random.Int63n(int64(time.Minute)))), index: -1}
+	}
+	return timers
+}
+
+type offsetClock struct {
+	offset time.Duration
+}
+
+func (this offsetClock) Now() time.Time {
+	return time.Now().Add(this.offset)
+}
+
+func TestLoopClock(t *testing.T) {
+	clock := offsetClock{offset: time.Hour * 24}
+	options := DefaultLoopOptions()
+	loop := StartLoopWith(*options.SetClock(clock))
+	defer loop.Cancel()
+	results := make(chan [2]time.Time, 1)
+	loop.Execute(ExecFunc(func() error {
+		start := Now()
+		After(time.Millisecond*20, func() error {
+			results <- [2]time.Time{start, Now()}
+			return nil
+		})
+		return nil
+	}))
+	select {
+	case result := <-results:
+		if result[0].Before(time.Now().Add(time.Hour*23)) || result[1].Sub(result[0]) < time.Millisecond*20 {
+			t.Fatalf("expect loop time from the clock, got %v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire on the clock")
+	}
+}
+
+func TestTimerWheel(t *testing.T) {
+	base := time.Unix(0, 0)
+	wheel := newtimerwheel(base)
+	random := rand.New(rand.NewSource(1))
+	timers := make([]*timer, 20000)
+	for i := range timers {
+		limit := time.Hour * 30
+		if i%3 == 0 {
+			limit = time.Second
+		}
+		timers[i] = &timer{next: base.Add(time.Duration(random.Int63n(int64(limit)))), index: -1}
+		wheel.add(timers[i])
+	}
+	for _, timer := range timers[:5000] {
+		wheel.remove(timer)
+	}
+	count := 0
+	last := int64(-1)
+	for wheel.total != 0 {
+		now, _ := wheel.deadline()
+		wheel.advance(now, func(timer *timer) {
+			if timer.next.After(now) || now.Sub(timer.next) > wheeltick {
+				t.Fatalf("timer %v expired at %v", timer.next, now)
+			}
+			tick := wheel.tickof(timer.next)
+			if tick < last {
+				t.Fatalf("timer %v expired out of order", timer.next)
+			}
+			last = tick
+			count++
+		})
+	}
+	if count != 15000 {
+		t.Fatalf("expect 15000 timers expired, got %d", count)
+	}
+}
+
+func BenchmarkTimerWheelStartStop(b *testing.B) {
+	wheel := newtimerwheel(time.Unix(0, 0))
+	timers := benchmarkTimerList(benchmarkTimers)
+	for _, timer := range timers {
+		wheel.add(timer)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		timer := timers[i%len(timers)]
+		wheel.remove(timer)
+		wheel.add(timer)
+	}
+}
+
+func BenchmarkTimerHeapStartStop(b *testing.B) {
+	var list timerlist
+	heap.Init(&list)
+	timers := benchmarkTimerList(benchmarkTimers)
+	for _, timer := range timers {
+		heap.Push(&list, timer)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		timer := timers[i%len(timers)]
+		heap.Remove(&list, timer.index)
+		heap.Push(&list, timer)
+	}
+}
+
+func BenchmarkTimerWheelExpire(b *testing.B) {
+	base := time.Unix(0, 0)
+	timers := benchmarkTimerList(benchmarkTimers)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(timers) {
+		wheel := newtimerwheel(base)
+		for _, timer := range timers {
+			wheel.add(timer)
+		}
+		wheel.advance(base.Add(time.Minute), func(*timer) {})
+	}
+}
+
+func BenchmarkTimerHeapExpire(b *testing.B) {
+	base := time.Unix(0, 0)
+	timers := benchmarkTimerList(benchmarkTimers)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(timers) {
+		var list timerlist
+		heap.Init(&list)
+		for _, timer := range timers {
+			heap.Push(&list, timer)
+		}
+		now := base.Add(time.Minute)
+		for list.length != 0 && !list.timers[0].next.After(now) {
+			heap.Pop(&list)
+		}
+	}
+}
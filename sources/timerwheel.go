@@ -0,0 +1,259 @@
+package relay
+
+import (
+	"time"
+)
+
+const (
+	wheelbits   = 6
+	wheelsize   = 1 << wheelbits
+	wheelmask   = wheelsize - 1
+	wheellevels = 6
+	wheeltick   = time.Millisecond
+)
+
+type timerwheel struct {
+	base    time.Time
+	current int64
+	total   int
+	counts  [wheellevels]int
+	slots   [wheellevels][wheelsize]timerbucket
+}
+
+type timerbucket struct {
+	head *timer
+	tail *timer
+}
+
+type wheeltimers struct {
+	loop     *loop
+	clock    Clock
+	wheel    *timerwheel
+	timer    *time.Timer
+	deadline time.Time
+	tick     Executor
+}
+
+func newtimerwheel(base time.Time) *timerwheel {
+	return &timerwheel{base: base}
+}
+
+func (this *timerwheel) tickof(t time.Time) int64 {
+	elapsed := t.Sub(this.base)
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64((elapsed + wheeltick - 1) / wheeltick)
+}
+
+func (this *timerwheel) timeof(tick int64) time.Time {
+	return this.base.Add(time.Duration(tick) * wheeltick)
+}
+
+func (this *timerwheel) add(timer *timer) {
+	expire := this.tickof(timer.next)
+	delta := expire - this.current
+	if delta < 0 {
+		delta = 0
+		expire = this.current
+	}
+	level := 0
+	for level < wheellevels-1 && delta >= int64(1)<<(wheelbits*(level+1)) {
+		level++
+	}
+	if delta >= int64(1)<<(wheelbits*wheellevels) {
+		expire = this.current + int64(1)<<(wheelbits*wheellevels) - 1
+	}
+	bucket := &this.slots[level][(expire>>(wheelbits*level))&wheelmask]
+	timer.bucket = bucket
+	timer.level = level
+	timer.before = bucket.tail
+	timer.after = nil
+	if bucket.tail != nil {
+		bucket.tail.after = timer
+	} else {
+		bucket.head = timer
+	}
+	bucket.tail = timer
+	this.counts[level]++
+	this.total++
+}
+
+func (this *timerwheel) remove(timer *timer) bool {
+	bucket := timer.bucket
+	if bucket == nil {
+		return false
+	}
+	if timer.before != nil {
+		timer.before.after = timer.after
+	} else {
+		bucket.head = timer.after
+	}
+	if timer.after != nil {
+		timer.after.before = timer.before
+	} else {
+		bucket.tail = timer.before
+	}
+	timer.bucket = nil
+	timer.before = nil
+	timer.after = nil
+	this.counts[timer.level]--
+	this.total--
+	return true
+}
+
+func (this *timerwheel) take(bucket *timerbucket) *timer {
+	head := bucket.head
+	bucket.head = nil
+	bucket.tail = nil
+	return head
+}
+
+func (this *timerwheel) cascade(level int) bool {
+	index := (this.current >> (wheelbits * level)) & wheelmask
+	timer := this.take(&this.slots[level][index])
+	for timer != nil {
+		after := timer.after
+		timer.bucket = nil
+		timer.before = nil
+		timer.after = nil
+		this.counts[level]--
+		this.total--
+		this.add(timer)
+		timer = after
+	}
+	return index == 0
+}
+
+func (this *timerwheel) advance(now time.Time, expire func(*timer)) {
+	target := int64(now.Sub(this.base) / wheeltick)
+	for this.current <= target {
+		if this.total == 0 {
+			this.current = target + 1
+			break
+		}
+		if this.counts[0] == 0 && this.current&wheelmask != 0 {
+			step := int64(wheelsize)
+			for level := 1; level < wheellevels-1 && this.counts[level] == 0; level++ {
+				step <<= wheelbits
+			}
+			next := (this.current | (step - 1)) + 1
+			if next > target {
+				this.current = target + 1
+				break
+			}
+			this.current = next
+			continue
+		}
+		if this.current&wheelmask == 0 {
+			for level := 1; level < wheellevels; level++ {
+				if !this.cascade(level) {
+					break
+				}
+			}
+		}
+		timer := this.take(&this.slots[0][this.current&wheelmask])
+		this.current++
+		for timer != nil {
+			after := timer.after
+			timer.bucket = nil
+			timer.before = nil
+			timer.after = nil
+			this.counts[0]--
+			this.total--
+			expire(timer)
+			timer = after
+		}
+	}
+}
+
+func (this *timerwheel) deadline() (time.Time, bool) {
+	if this.total == 0 {
+		return time.Time{}, false
+	}
+	if this.current&wheelmask == 0 {
+		return this.timeof(this.current), true
+	}
+	if this.counts[0] != 0 {
+		for i := int64(0); i < wheelsize; i++ {
+			tick := this.current + i
+			if tick&wheelmask == 0 || this.slots[0][tick&wheelmask].head != nil {
+				return this.timeof(tick), true
+			}
+		}
+	}
+	step := int64(wheelsize)
+	for level := 1; level < wheellevels-1 && this.counts[level] == 0; level++ {
+		step <<= wheelbits
+	}
+	return this.timeof((this.current | (step - 1)) + 1), true
+}
+
+type systemclock struct {
+}
+
+func (this systemclock) Now() time.Time {
+	return time.Now()
+}
+
+func newwheeltimers(loop *loop, clock Clock) *wheeltimers {
+	if clock == nil {
+		clock = systemclock{}
+	}
+	result := &wheeltimers{loop: loop, clock: clock}
+	result.tick = ExecFunc(func() error {
+		result.advance()
+		return nil
+	})
+	return result
+}
+
+func (this *wheeltimers) now() time.Time {
+	return this.clock.Now()
+}
+
+func (this *wheeltimers) start(timer *timer) {
+	if this.wheel == nil {
+		this.wheel = newtimerwheel(this.clock.Now())
+	}
+	this.wheel.add(timer)
+	this.arm()
+}
+
+func (this *wheeltimers) stop(timer *timer) {
+	if this.wheel != nil {
+		this.wheel.remove(timer)
+	}
+}
+
+func (this *wheeltimers) advance() {
+	this.deadline = time.Time{}
+	now := this.clock.Now()
+	this.wheel.advance(now, func(timer *timer) {
+		if timer.next.After(now) {
+			this.wheel.add(timer)
+		} else if timer.fire(now) {
+			this.wheel.add(timer)
+		}
+	})
+	this.arm()
+}
+
+func (this *wheeltimers) arm() {
+	deadline, ok := this.wheel.deadline()
+	if !ok {
+		return
+	}
+	if !this.deadline.IsZero() && !deadline.Before(this.deadline) {
+		return
+	}
+	this.deadline = deadline
+	delay := deadline.Sub(this.clock.Now())
+	if this.timer == nil {
+		this.timer = time.AfterFunc(delay, func() {
+			this.loop.ExecuteUrgent(this.tick)
+		})
+	} else {
+		this.timer.Reset(delay)
+	}
+}
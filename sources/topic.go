@@ -0,0 +1,204 @@
+package relay
+
+import (
+	gerrors "errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrNoSubscriber = gerrors.New("no subscriber")
+
+type Topic[T any] string
+
+type DeadLetter struct {
+	Topic string
+	Value any
+	Loop  string
+	Err   error
+}
+
+func (this Topic[T]) Publish(value T) error {
+	return bus.publish(string(this), reflect.TypeOf((*T)(nil)).Elem(), value)
+}
+
+func (this Topic[T]) Subscribe(listener func(T) error) func() {
+	return Subscribe(string(this), func(topic Topic[T], value T) error {
+		return listener(value)
+	})
+}
+
+func Subscribe[T any](pattern string, listener func(Topic[T], T) error) func() {
+	subscription := &subscription{
+		segments: strings.Split(pattern, "."),
+		typeof:   reflect.TypeOf((*T)(nil)).Elem(),
+		loop:     InLoop(),
+		deliver: func(topic string, value any) error {
+			return listener(Topic[T](topic), value.(T))
+		},
+	}
+	bus.add(subscription)
+	return func() {
+		atomic.StoreInt32(&subscription.removed, 1)
+		bus.remove(subscription)
+	}
+}
+
+func OnDeadLetter(handler func(DeadLetter)) func() {
+	bus.guard.Lock()
+	defer bus.guard.Unlock()
+	bus.seq++
+	seq := bus.seq
+	bus.deadletters = append(bus.deadletters, deadletterhandler{seq: seq, handler: handler})
+	return func() {
+		bus.guard.Lock()
+		defer bus.guard.Unlock()
+		for i, element := range bus.deadletters {
+			if element.seq == seq {
+				bus.deadletters = append(bus.deadletters[:i:i], bus.deadletters[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+var bus = &topicbus{exact: make(map[string][]*subscription)}
+
+type topicbus struct {
+	guard       sync.RWMutex
+	exact       map[string][]*subscription
+	patterns    []*subscription
+	deadletters []deadletterhandler
+	seq         uint64
+}
+
+type deadletterhandler struct {
+	seq     uint64
+	handler func(DeadLetter)
+}
+
+type subscription struct {
+	segments []string
+	typeof   reflect.Type
+	loop     Loop
+	deliver  func(topic string, value any) error
+	removed  int32
+}
+
+func (this *topicbus) add(subscription *subscription) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if subscription.wildcard() {
+		this.patterns = append(this.patterns[:len(this.patterns):len(this.patterns)], subscription)
+	} else {
+		topic := strings.Join(subscription.segments, ".")
+		list := this.exact[topic]
+		this.exact[topic] = append(list[:len(list):len(list)], subscription)
+	}
+}
+
+func (this *topicbus) remove(subscription *subscription) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+	if subscription.wildcard() {
+		this.patterns = removesubscription(this.patterns, subscription)
+	} else {
+		topic := strings.Join(subscription.segments, ".")
+		list := removesubscription(this.exact[topic], subscription)
+		if len(list) == 0 {
+			delete(this.exact, topic)
+		} else {
+			this.exact[topic] = list
+		}
+	}
+}
+
+func (this *topicbus) publish(topic string, typeof reflect.Type, value any) error {
+	this.guard.RLock()
+	targets := this.exact[topic]
+	if len(this.patterns) != 0 {
+		segments := strings.Split(topic, ".")
+		targets = targets[:len(targets):len(targets)]
+		for _, subscription := range this.patterns {
+			if subscription.match(segments) {
+				targets = append(targets, subscription)
+			}
+		}
+	}
+	this.guard.RUnlock()
+	delivered := false
+	var errors []error
+	for _, target := range targets {
+		if target.typeof != typeof {
+			continue
+		}
+		delivered = true
+		target := target
+		err := target.loop.Execute(ExecFunc(func() error {
+			if atomic.LoadInt32(&target.removed) != 0 {
+				return nil
+			}
+			if err := target.deliver(topic, value); err != nil {
+				this.deadletter(DeadLetter{Topic: topic, Value: value, Loop: LoopName(target.loop), Err: err})
+			}
+			return nil
+		}))
+		if err != nil {
+			this.deadletter(DeadLetter{Topic: topic, Value: value, Loop: LoopName(target.loop), Err: err})
+			errors = append(errors, err)
+		}
+	}
+	if !delivered {
+		this.deadletter(DeadLetter{Topic: topic, Value: value, Err: ErrNoSubscriber})
+	}
+	return joinerrors(errors)
+}
+
+func (this *topicbus) deadletter(letter DeadLetter) {
+	this.guard.RLock()
+	handlers := this.deadletters
+	this.guard.RUnlock()
+	if len(handlers) == 0 {
+		if letter.Err != ErrNoSubscriber {
+			Logger().Error().Err(letter.Err).Str("topic", letter.Topic).Str("subscriber", letter.Loop).Msg("topic listener failed")
+		}
+		return
+	}
+	for _, element := range handlers {
+		element.handler(letter)
+	}
+}
+
+func (this *subscription) wildcard() bool {
+	for _, segment := range this.segments {
+		if segment == "*" || segment == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *subscription) match(segments []string) bool {
+	for i, segment := range this.segments {
+		if segment == ">" {
+			return i < len(segments)
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if segment != "*" && segment != segments[i] {
+			return false
+		}
+	}
+	return len(this.segments) == len(segments)
+}
+
+func removesubscription(list []*subscription, subscription *subscription) []*subscription {
+	for i, element := range list {
+		if element == subscription {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
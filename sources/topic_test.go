@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type testlogin struct {
+	ID int
+}
+
+func TestTopicWildcards(t *testing.T) {
+	loop := StartLoop()
+	defer loop.Cancel()
+	received := make(chan string, 8)
+	letters := make(chan DeadLetter, 8)
+	defer OnDeadLetter(func(letter DeadLetter) {
+		letters <- letter
+	})()
+	ready := make(chan func())
+	loop.Execute(ExecFunc(func() error {
+		var unsubscribes []func()
+		unsubscribes = append(unsubscribes, Topic[testlogin]("test.player.login").Subscribe(func(value testlogin) error {
+			received <- "exact"
+			return nil
+		}))
+		unsubscribes = append(unsubscribes, Subscribe("test.player.*", func(topic Topic[testlogin], value testlogin) error {
+			received <- "star:" + string(topic)
+			return nil
+		}))
+		unsubscribes = append(unsubscribes, Subscribe("test.>", func(topic Topic[testlogin], value testlogin) error {
+			return errors.Errorf("reject %d", value.ID)
+		}))
+		unsubscribes = append(unsubscribes, Subscribe("test.>", func(topic Topic[string], value string) error {
+			received <- "string:" + value
+			return nil
+		}))
+		ready <- func() {
+			for _, unsubscribe := range unsubscribes {
+				unsubscribe()
+			}
+		}
+		return nil
+	}))
+	unsubscribe := <-ready
+	if err := Topic[testlogin]("test.player.login").Publish(testlogin{ID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	var results []string
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-received:
+			results = append(results, result)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	sort.Strings(results)
+	if results[0] != "exact" || results[1] != "star:test.player.login" {
+		t.Fatalf("unexpected deliveries %v", results)
+	}
+	select {
+	case letter := <-letters:
+		if letter.Topic != "test.player.login" || letter.Err.Error() != "reject 7" || letter.Loop != LoopName(loop) {
+			t.Fatalf("unexpected dead letter %+v", letter)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect a dead letter")
+	}
+	unsubscribe()
+	Topic[testlogin]("test.player.logout").Publish(testlogin{ID: 8})
+	select {
+	case letter := <-letters:
+		if letter.Err != ErrNoSubscriber {
+			t.Fatalf("unexpected dead letter %+v", letter)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect an undelivered dead letter")
+	}
+}